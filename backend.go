@@ -0,0 +1,98 @@
+package main
+
+//
+// This file contains the render backends, which display the frames of the gamehost
+//
+
+import "fmt"
+
+// The gamehost runs its loop, systems and events the same way for every backend. Only
+// the backend knows whether, and where to, the frames are rendered.
+type RenderBackend interface {
+	// Opens the window and sets up the graphics context
+	Open() error
+
+	// Renders the world and the graphics calls queued by scripts, then shows the frame.
+	// Alpha (0 to 1) is the fraction of a time step passed since the last update, which
+	// positions can be interpolated by.
+	Render(world *World, alpha float64)
+
+	// Returns true once the user has asked to close the window
+	ShouldClose() bool
+
+	SetTitle(title string)
+
+	// Closes the window and releases the graphics context
+	Close()
+}
+
+// Runs the game without window or graphics context, e.g. on servers or in tests
+type HeadlessBackend struct{}
+
+func (b *HeadlessBackend) Open() error {
+	return nil
+}
+
+// Nothing is rendered, the queued graphics calls are dropped
+func (b *HeadlessBackend) Render(world *World, alpha float64) {
+	graphicsQueue.Clear()
+}
+
+func (b *HeadlessBackend) ShouldClose() bool {
+	return false
+}
+
+func (b *HeadlessBackend) SetTitle(title string) {
+}
+
+func (b *HeadlessBackend) Close() {
+}
+
+// Runs the game without window and writes every frame into a PNG file, rendered by the
+// software renderer
+type PNGBackend struct {
+	// name of the files containing the frame number, e.g. frames/%04d.png
+	Path string
+
+	renderer *SoftwareRenderer
+
+	// frames are only written once per update
+	frame int
+}
+
+func NewPNGBackend(path string, width, height int) *PNGBackend {
+	return &PNGBackend{Path: path, renderer: NewSoftwareRenderer(width, height), frame: -1}
+}
+
+func (b *PNGBackend) Open() error {
+	b.renderer.SetClearColor(Color{1, 1, 1, 1})
+	return nil
+}
+
+func (b *PNGBackend) Render(world *World, alpha float64) {
+	frame, _, _ := gamehost_clock.Now()
+	if frame == b.frame {
+		return
+	}
+	b.frame = frame
+
+	// changes of the camera and the clear colour apply to the frame they were made for
+	graphicsQueue.Process(b.renderer)
+	b.renderer.BeginFrame()
+	world.Render(b.renderer)
+	b.renderer.EndFrame()
+
+	if err := b.renderer.SavePNG(fmt.Sprintf(b.Path, frame)); err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+func (b *PNGBackend) ShouldClose() bool {
+	return false
+}
+
+func (b *PNGBackend) SetTitle(title string) {
+}
+
+func (b *PNGBackend) Close() {
+}
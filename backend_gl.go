@@ -0,0 +1,60 @@
+package main
+
+import glfw "github.com/go-gl/glfw3"
+import "errors"
+
+// Renders into a GLFW window with OpenGL
+type GLBackend struct {
+	Width, Height int
+
+	window   *glfw.Window
+	renderer *GLRenderer
+}
+
+func NewGLBackend() *GLBackend {
+	return &GLBackend{Width: 800, Height: 600}
+}
+
+func (b *GLBackend) Open() error {
+	if !glfw.Init() {
+		return errors.New("Cannot init GLFW")
+	}
+
+	window, err := glfw.CreateWindow(b.Width, b.Height, "Apollo", nil, nil)
+	if err != nil {
+		glfw.Terminate()
+		return err
+	}
+
+	window.MakeContextCurrent()
+	b.window = window
+
+	width, height := window.GetFramebufferSize()
+	b.renderer = NewGLRenderer(width, height)
+	b.renderer.SetClearColor(Color{1, 1, 1, 1})
+	return nil
+}
+
+// The world doesn't move between updates yet, so it is rendered without interpolation
+func (b *GLBackend) Render(world *World, alpha float64) {
+	// changes of the camera and the clear colour apply to the frame they were made for
+	graphicsQueue.Process(b.renderer)
+	b.renderer.BeginFrame()
+	world.Render(b.renderer)
+	b.renderer.EndFrame()
+
+	b.window.SwapBuffers()
+	glfw.PollEvents()
+}
+
+func (b *GLBackend) ShouldClose() bool {
+	return b.window.ShouldClose()
+}
+
+func (b *GLBackend) SetTitle(title string) {
+	b.window.SetTitle(title)
+}
+
+func (b *GLBackend) Close() {
+	glfw.Terminate()
+}
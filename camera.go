@@ -0,0 +1,225 @@
+package main
+
+//
+// This file contains the camera that scripts control
+//
+
+import "fmt"
+import "math"
+import "sync"
+
+// The camera as set by scripts. Changes are passed on to the renderer through the graphics
+// queue, so they take effect when the next frame is rendered. Updates that fail, e.g. due
+// to invalid arguments, leave the camera unchanged.
+var scriptCamera = struct {
+	sync.Mutex
+	camera Camera
+}{camera: DefaultCamera()}
+
+func updateCamera(update func(camera *Camera)) {
+	scriptCamera.Lock()
+	defer scriptCamera.Unlock()
+
+	camera := scriptCamera.camera
+	update(&camera)
+	scriptCamera.camera = camera
+
+	graphicsQueue.Enqueue(func(renderer Renderer) {
+		renderer.SetCamera(camera)
+	})
+}
+
+// Rotates the vector around the axis by the angle in degrees, counterclockwise when looking
+// against the axis
+func rotateAround(v Vertex3D, axis Vertex3D, degrees float64) Vertex3D {
+	k := axis.Normalize()
+	sin, cos := math.Sincos(degrees * math.Pi / 180)
+
+	// Rodrigues' rotation formula
+	return v.Scale(cos).Add(k.Cross(v).Scale(sin)).Add(k.Scale(k.Dot(v) * (1 - cos)))
+}
+
+// Rotates the direction by yaw degrees around the up axis and by pitch degrees up or down.
+// The pitch is limited so that the direction never turns over the up axis.
+func turn(direction Vertex3D, up Vertex3D, yaw float64, pitch float64) Vertex3D {
+	direction = rotateAround(direction, up, yaw)
+
+	// angle between the direction and the up axis, which is lowered by pitching up
+	cosine := math.Max(-1, math.Min(1, direction.Normalize().Dot(up.Normalize())))
+	angle := math.Acos(cosine) * 180 / math.Pi
+	pitch = math.Max(angle-179, math.Min(angle-1, pitch))
+
+	// looking along the up axis, the view is turned as by ViewMatrix
+	right := direction.Cross(up)
+	if right.Length() <= 1e-9*up.Length() {
+		right = direction.Cross(perpendicularAxis(direction))
+	}
+	return rotateAround(direction, right, pitch)
+}
+
+// panics unless the number of arguments is one of the given counts
+func requireArgumentCount(function string, args List, counts ...int) {
+	expected := ""
+	for i, count := range counts {
+		if args.Len() == count {
+			return
+		}
+
+		if i > 0 {
+			expected += " or "
+		}
+		expected += fmt.Sprint(count)
+	}
+
+	panic(fmt.Sprintf("%s expects %s arguments, %d provided", function, expected, args.Len()))
+}
+
+func vertexArgument(data Data) Vertex3D {
+	items := sequenceItems(data)
+	if len(items) != 3 {
+		panic(fmt.Sprintf("%s is not a vector [x y z]", data.String()))
+	}
+
+	return Vertex3D{numberArgument(items[0]), numberArgument(items[1]), numberArgument(items[2])}
+}
+
+func numberArgument(data Data) float64 {
+	switch t := data.(type) {
+	case Int:
+		return float64(t.Value)
+	case Float:
+		return t.Value
+	}
+
+	panic(fmt.Sprintf("%s is not a number", data.String()))
+}
+
+func vertexData(v Vertex3D) Vector {
+	return MakeVector(Float{v.X}, Float{v.Y}, Float{v.Z})
+}
+
+//-----------------------------------------------------------------------------
+// Native Functions for the camera
+
+// (camera) - returns the camera as dict with the keys :position, :target, :up,
+// :field-of-view, :near, :far and :orthographic
+func _camera(args List, context *Context) Data {
+	scriptCamera.Lock()
+	camera := scriptCamera.camera
+	scriptCamera.Unlock()
+
+	dict := CreateDict()
+	dict.Put(Keyword{":position"}, vertexData(camera.Position))
+	dict.Put(Keyword{":target"}, vertexData(camera.Target))
+	dict.Put(Keyword{":up"}, vertexData(camera.Up))
+	dict.Put(Keyword{":field-of-view"}, Float{camera.FieldOfView})
+	dict.Put(Keyword{":near"}, Float{camera.Near})
+	dict.Put(Keyword{":far"}, Float{camera.Far})
+	dict.Put(Keyword{":orthographic"}, Bool{camera.Orthographic})
+	return dict
+}
+
+// (camera-look-at [x y z] [target-x target-y target-z] [[up-x up-y up-z]])
+func _camera_look_at(args List, context *Context) Data {
+	requireArgumentCount("camera-look-at", args, 2, 3)
+	updateCamera(func(camera *Camera) {
+		camera.Position = vertexArgument(args.First())
+		camera.Target = vertexArgument(args.Second())
+		if args.Len() > 2 {
+			camera.Up = vertexArgument(args.Third())
+		}
+
+		if camera.Position == camera.Target {
+			panic("The camera cannot look at its own position")
+		}
+		if camera.Up.Length() == 0 {
+			panic("The up axis of the camera must not be zero")
+		}
+	})
+
+	return Nothing{}
+}
+
+// (camera-move [dx dy dz]) - moves the camera and its target
+func _camera_move(args List, context *Context) Data {
+	args.RequireArity(1)
+	offset := vertexArgument(args.First())
+
+	updateCamera(func(camera *Camera) {
+		camera.Position = camera.Position.Add(offset)
+		camera.Target = camera.Target.Add(offset)
+	})
+
+	return Nothing{}
+}
+
+// (camera-turn yaw pitch) - turns the camera around its position by the angles in degrees,
+// e.g. to look around with a first-person camera
+func _camera_turn(args List, context *Context) Data {
+	args.RequireArity(2)
+	yaw, pitch := numberArgument(args.First()), numberArgument(args.Second())
+
+	updateCamera(func(camera *Camera) {
+		direction := turn(camera.Target.Sub(camera.Position), camera.Up, yaw, pitch)
+		camera.Target = camera.Position.Add(direction)
+	})
+
+	return Nothing{}
+}
+
+// (camera-orbit yaw pitch) - moves the camera around its target by the angles in degrees,
+// a positive pitch moves it up
+func _camera_orbit(args List, context *Context) Data {
+	args.RequireArity(2)
+	yaw, pitch := numberArgument(args.First()), numberArgument(args.Second())
+
+	updateCamera(func(camera *Camera) {
+		offset := turn(camera.Position.Sub(camera.Target), camera.Up, yaw, pitch)
+		camera.Position = camera.Target.Add(offset)
+	})
+
+	return Nothing{}
+}
+
+// (camera-perspective field-of-view [near far]) - field of view in degrees
+func _camera_perspective(args List, context *Context) Data {
+	requireArgumentCount("camera-perspective", args, 1, 3)
+	updateCamera(func(camera *Camera) {
+		camera.Orthographic = false
+		camera.FieldOfView = numberArgument(args.First())
+		if args.Len() > 2 {
+			camera.Near, camera.Far = numberArgument(args.Second()), numberArgument(args.Third())
+		}
+
+		// negated comparisons reject NaN as well
+		if !(camera.FieldOfView > 0 && camera.FieldOfView < 180) {
+			panic("The field of view must lie between 0 and 180 degrees")
+		}
+		if !(camera.Near > 0) {
+			panic("The near plane of a perspective camera must lie in front of it")
+		}
+		if !(camera.Near < camera.Far) {
+			panic("The near plane must lie in front of the far plane")
+		}
+	})
+
+	return Nothing{}
+}
+
+// (camera-orthographic [near far]) - shows what the perspective camera shows at the distance
+// of its target without perspective distortion
+func _camera_orthographic(args List, context *Context) Data {
+	requireArgumentCount("camera-orthographic", args, 0, 2)
+	updateCamera(func(camera *Camera) {
+		camera.Orthographic = true
+		if args.Len() > 1 {
+			camera.Near, camera.Far = numberArgument(args.First()), numberArgument(args.Second())
+		}
+
+		if !(camera.Near < camera.Far) {
+			panic("The near plane must lie in front of the far plane")
+		}
+	})
+
+	return Nothing{}
+}
@@ -0,0 +1,469 @@
+package main
+
+//
+// This file contains the compiler, which translates code into the bytecode
+// run by the virtual machine (see vm.go)
+//
+
+import "reflect"
+
+type Opcode byte
+
+const (
+	// pushes constant A
+	opConst Opcode = iota
+	// pushes slot B of the context A levels up the context chain
+	opLocal
+	// pushes the value of the symbol in constant A, looked up by name
+	opName
+	// checks the callee on top of the stack. Functions receiving evaluated arguments
+	// are called by the following instructions, everything else receives the unevaluated
+	// arguments of the call form in constant A and execution continues at B
+	opCallee
+	// calls the callee below the A arguments on top of the stack
+	opCall
+	// like opCall, but replaces the current call frame
+	opTailCall
+	// pops a Bool and jumps to A if it is false
+	opJumpIfFalse
+	// jumps to A
+	opJump
+	// discards the value on top of the stack
+	opPop
+	// defines the symbol in constant A as the value on top of the stack
+	opDefine
+	// creates a function from prototype A, B being one of the function modes below
+	opFunction
+	// enters a context whose slots named by scope A are set to the values on top of the stack
+	opPushScope
+	// leaves the context entered by opPushScope
+	opPopScope
+	// raises the error message in constant A
+	opRaise
+	// returns the value on top of the stack from the current call frame
+	opReturn
+)
+
+// the ways opFunction handles the created function
+const (
+	functionValue = iota
+	functionDefine
+	functionExtend
+)
+
+type Instruction struct {
+	Op Opcode
+	A  int
+	B  int
+}
+
+// Chunk is a compiled piece of code
+type Chunk struct {
+	Code      []Instruction
+	Constants []Data
+
+	// source position of each instruction, used to locate runtime errors
+	Positions []*SourcePos
+
+	// names of the slots of the call context, i.e. the function parameters
+	Locals []string
+
+	// names of the slots of contexts created by let
+	Scopes [][]string
+
+	// functions defined within the chunk
+	Functions []*functionPrototype
+}
+
+// names of the slots available at compile time, mirroring the contexts at runtime
+type scope struct {
+	names  []string
+	parent *scope
+}
+
+// returns how many contexts up the chain a name is defined and its slot index
+func (s *scope) resolve(name string) (depth int, index int, ok bool) {
+	for ; s != nil; s = s.parent {
+		for i := len(s.names) - 1; i >= 0; i-- {
+			if s.names[i] == name {
+				return depth, i, true
+			}
+		}
+		depth++
+	}
+
+	return 0, 0, false
+}
+
+type compiler struct {
+	chunk *Chunk
+	scope *scope
+
+	// context for looking up special forms and macros while compiling
+	context *Context
+}
+
+// compiles a special form, returns false if the form is malformed so that it is
+// called at runtime instead, which reports the error
+type formCompiler func(c *compiler, form List, tail bool) bool
+
+// special forms by native function, see init()
+var specialForms map[uintptr]formCompiler
+
+func init() {
+	specialForms = map[uintptr]formCompiler{
+		nativePointer(_if):              compileIf,
+		nativePointer(_do):              compileDo,
+		nativePointer(_let):             compileLet,
+		nativePointer(_def):             compileDef,
+		nativePointer(_quote):           compileQuote,
+		nativePointer(_fn):              compileFn,
+		nativePointer(_lambda):          compileLambda,
+		nativePointer(_defn):            compileDefn,
+		nativePointer(_extend_function): compileExtendFunction,
+	}
+}
+
+func nativePointer(function func(List, *Context) Data) uintptr {
+	return reflect.ValueOf(function).Pointer()
+}
+
+// Compiles code that is evaluated in the given context
+func Compile(code Data, context *Context) *Chunk {
+	c := &compiler{chunk: new(Chunk), context: context}
+	c.compile(code, true)
+	c.emit(opReturn, 0, 0, nil)
+
+	return c.chunk
+}
+
+// Compiles the code of a dispatch pattern, whose parameters are bound to the slots
+// of the call context. enclosing are the names available where the function is defined.
+func CompileFunctionBody(dispatch *DispatchPattern, enclosing *scope, context *Context) *Chunk {
+	c := &compiler{chunk: new(Chunk), context: context}
+	c.chunk.Locals = dispatch.slotNames()
+	c.scope = &scope{c.chunk.Locals, enclosing}
+	c.compile(dispatch.Code, true)
+	c.emit(opReturn, 0, 0, nil)
+
+	return c.chunk
+}
+
+func (c *compiler) emit(op Opcode, a int, b int, pos *SourcePos) int {
+	c.chunk.Code = append(c.chunk.Code, Instruction{op, a, b})
+	c.chunk.Positions = append(c.chunk.Positions, pos)
+	return len(c.chunk.Code) - 1
+}
+
+func (c *compiler) constant(value Data) int {
+	c.chunk.Constants = append(c.chunk.Constants, value)
+	return len(c.chunk.Constants) - 1
+}
+
+// sets the jump target of instruction i to the next instruction
+func (c *compiler) patch(i int) {
+	if c.chunk.Code[i].Op == opCallee {
+		c.chunk.Code[i].B = len(c.chunk.Code)
+	} else {
+		c.chunk.Code[i].A = len(c.chunk.Code)
+	}
+}
+
+// compiles code leaving its value on the stack. Calls in tail position replace the current call frame.
+func (c *compiler) compile(code Data, tail bool) {
+	switch t := code.(type) {
+	case List:
+		if t.evaluated {
+			// if the list was already evaluated just return its contents as is
+			c.emit(opConst, c.constant(t), 0, nil)
+		} else if t.Len() == 0 {
+			c.emit(opRaise, c.constant(String{"invalid function invocation"}), 0, t.pos)
+		} else {
+			c.compileList(t, tail)
+		}
+	case Symbol:
+		c.compileSymbol(t, t.pos)
+	default:
+		c.emit(opConst, c.constant(code), 0, nil)
+	}
+}
+
+func (c *compiler) compileSymbol(symbol Symbol, pos *SourcePos) {
+	if depth, index, ok := c.scope.resolve(symbol.Value); ok {
+		c.emit(opLocal, depth, index, pos)
+	} else {
+		c.emit(opName, c.constant(symbol), 0, pos)
+	}
+}
+
+func (c *compiler) compileList(form List, tail bool) {
+	head := form.First()
+
+	// special forms and macros are resolved while compiling unless they are shadowed by locals
+	if symbol, ok := head.(Symbol); ok {
+		if _, _, local := c.scope.resolve(symbol.Value); !local {
+			switch def := c.context.LookUp(symbol).(type) {
+			case NativeFunctionB:
+				if compileForm, ok := specialForms[nativePointer(def.Function)]; ok && compileForm(c, form, tail) {
+					return
+				}
+			case *Macro:
+				if expansion, ok := expandMacro(def, form.SliceFrom(1)); ok {
+					c.compile(expansion, tail)
+					return
+				}
+			}
+		}
+	}
+
+	// first expression must be a symbol or an expression yielding a function
+	switch t := head.(type) {
+	case Symbol:
+		c.compileSymbol(t, form.pos)
+	case List:
+		// e.g. ((make-adder 5) 10)
+		c.compile(t, false)
+	default:
+		c.emit(opConst, c.constant(head), 0, nil)
+	}
+
+	callee := c.emit(opCallee, c.constant(form), 0, form.pos)
+	for e := form.Front().Next(); e != nil; e = e.Next() {
+		c.compile(e.Value.(Data), false)
+	}
+
+	if tail {
+		c.emit(opTailCall, form.Len()-1, 0, form.pos)
+	} else {
+		c.emit(opCall, form.Len()-1, 0, form.pos)
+	}
+	c.patch(callee)
+}
+
+// compiles the expressions like do, leaving the value of the last one on the stack
+func (c *compiler) compileBody(exprs List, tail bool, pos *SourcePos) {
+	if exprs.Len() == 0 {
+		c.emit(opConst, c.constant(Nothing{}), 0, pos)
+		return
+	}
+
+	for e := exprs.Front(); e != exprs.Back(); e = e.Next() {
+		c.compile(e.Value.(Data), false)
+		c.emit(opPop, 0, 0, pos)
+	}
+
+	c.compile(exprs.Last(), tail)
+}
+
+// expands a macro call while compiling. If the expansion fails the macro is called
+// at runtime instead, so that the error is only raised if the call is executed.
+func expandMacro(macro *Macro, args List) (expansion Data, ok bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			expansion, ok = nil, false
+		}
+	}()
+
+	return macro.Expand(args), true
+}
+
+// (if cond ifTrue [ifFalse])
+func compileIf(c *compiler, form List, tail bool) bool {
+	if form.Len() != 3 && form.Len() != 4 {
+		return false
+	}
+
+	c.compile(form.Second(), false)
+	jumpToElse := c.emit(opJumpIfFalse, 0, 0, form.pos)
+
+	c.compile(form.Third(), tail)
+	jumpToEnd := c.emit(opJump, 0, 0, form.pos)
+
+	c.patch(jumpToElse)
+	if form.Len() > 3 {
+		c.compile(form.Get(3), tail)
+	} else {
+		c.emit(opConst, c.constant(Nothing{}), 0, nil)
+	}
+	c.patch(jumpToEnd)
+
+	return true
+}
+
+// (do (expr1) (expr2) ...)
+func compileDo(c *compiler, form List, tail bool) bool {
+	c.compileBody(form.SliceFrom(1), tail, form.pos)
+	return true
+}
+
+// (let [symbol expr symbol expr] expr*)
+func compileLet(c *compiler, form List, tail bool) bool {
+	if form.Len() < 2 {
+		return false
+	}
+
+	bindings, ok := form.Second().(List)
+	if !ok || bindings.evaluated {
+		return false
+	}
+	bindings = LiteralItems(bindings)
+
+	if bindings.Len()%2 != 0 {
+		return false
+	}
+
+	names := make([]string, 0, bindings.Len()/2)
+	for e := bindings.Front(); e != nil; e = e.Next().Next() {
+		symbol, ok := e.Value.(Symbol)
+		if !ok {
+			return false
+		}
+		names = append(names, symbol.Value)
+	}
+
+	// the values are evaluated in the outer context
+	for e := bindings.Front(); e != nil; e = e.Next().Next() {
+		c.compile(e.Next().Value.(Data), false)
+	}
+
+	c.chunk.Scopes = append(c.chunk.Scopes, names)
+	c.emit(opPushScope, len(c.chunk.Scopes)-1, 0, form.pos)
+
+	c.scope = &scope{names, c.scope}
+	c.compileBody(form.SliceFrom(2), tail, form.pos)
+	c.scope = c.scope.parent
+
+	// in tail position the context is left by returning
+	if !tail {
+		c.emit(opPopScope, 0, 0, form.pos)
+	}
+
+	return true
+}
+
+// (def symbol value)
+func compileDef(c *compiler, form List, tail bool) bool {
+	if form.Len() != 3 {
+		return false
+	}
+
+	symbol, ok := form.Second().(Symbol)
+	if !ok {
+		return false
+	}
+
+	c.compile(form.Third(), false)
+	c.emit(opDefine, c.constant(symbol), 0, form.pos)
+
+	return true
+}
+
+// (quote x)
+func compileQuote(c *compiler, form List, tail bool) bool {
+	if form.Len() != 2 {
+		return false
+	}
+
+	c.emit(opConst, c.constant(form.Second()), 0, nil)
+	return true
+}
+
+// (fn [name] args* stmts*)
+func compileFn(c *compiler, form List, tail bool) bool {
+	args := form.SliceFrom(1)
+	if args.Len() == 2 {
+		args.PushFront(Symbol{Value: "anonymous"})
+	}
+
+	return c.compileFunction(args, functionValue, form.pos)
+}
+
+// #(expr with placeholders)
+func compileLambda(c *compiler, form List, tail bool) bool {
+	params, body := lambdaDefinition(form.SliceFrom(1))
+	return c.compileFunction(MakeList(Symbol{Value: "anonymous-function-x"}, params, body), functionValue, form.pos)
+}
+
+// (defn name args* stmts*)
+func compileDefn(c *compiler, form List, tail bool) bool {
+	return c.compileFunction(form.SliceFrom(1), functionDefine, form.pos)
+}
+
+// (defn| name args* stmts*)
+func compileExtendFunction(c *compiler, form List, tail bool) bool {
+	return c.compileFunction(form.SliceFrom(1), functionExtend, form.pos)
+}
+
+// expects (name [params] body) like CreateFunction
+func (c *compiler) compileFunction(args List, mode int, pos *SourcePos) bool {
+	if args.Len() != 3 {
+		return false
+	}
+
+	name, ok := args.First().(Symbol)
+	if !ok {
+		return false
+	}
+
+	params, ok := args.Second().(List)
+	if !ok {
+		return false
+	}
+
+	prototype := &functionPrototype{
+		name:   name,
+		params: params,
+		code:   args.Third(),
+		scope:  c.scope,
+	}
+
+	c.chunk.Functions = append(c.chunk.Functions, prototype)
+	c.emit(opFunction, len(c.chunk.Functions)-1, mode, pos)
+
+	return true
+}
+
+// A function definition within compiled code. Its body is compiled when the
+// function is created for the first time, as macros may be defined until then.
+type functionPrototype struct {
+	name   Symbol
+	params List
+	code   Data
+	scope  *scope
+	body   *Chunk
+}
+
+// creates the function defined in the given context
+func (p *functionPrototype) instantiate(context *Context) *Function {
+	dispatcher := NewDispatchPattern(p.params, p.code, context)
+
+	// the parameter names may change if a symbol referred to a type before
+	body := p.body
+	if body == nil || !equalNames(body.Locals, dispatcher.slotNames()) {
+		body = CompileFunctionBody(dispatcher, p.scope, context)
+		if p.body == nil {
+			p.body = body
+		}
+	}
+	dispatcher.body = body
+
+	fn := new(Function)
+	fn.Name = p.name.Value
+	fn.SetDispatchers([]DispatchPattern{*dispatcher})
+
+	return fn
+}
+
+func equalNames(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -2,6 +2,19 @@ package main
 
 import "testing"
 import "fmt"
+import "image/png"
+import "math"
+import "os"
+import "path/filepath"
+import "runtime/debug"
+import "time"
+
+func TestMain(m *testing.M) {
+	InitRuntime()
+	code := m.Run()
+	ShutdownRuntime()
+	os.Exit(code)
+}
 
 // Ensure that the intrinsic types are available
 func TestTypes(t *testing.T) {
@@ -53,19 +66,1382 @@ func TestTypeInstances(t *testing.T) {
 
 func TestContext(t *testing.T) {
 	a := NewContext()
-	a.Define(Symbol{"print"}, String{"SOME_VALUE"})
+	a.Define(Symbol{Value: "print"}, String{"SOME_VALUE"})
 
 	b := NewContext()
 	b.parent = a
 
-	if !b.IsDefined(Symbol{"print"}) {
+	if !b.IsDefined(Symbol{Value: "print"}) {
 		t.Error("Subcontext must inherit parent's symbols")
 	}
 
 	c := NewContext()
 	c.parent = MainContext
 
-	if !c.IsDefined(Symbol{"type"}) {
+	if !c.IsDefined(Symbol{Value: "type"}) {
 		t.Error("Subcontext doesn't contain MainContext symbols")
 	}
 }
+
+func TestParseError(t *testing.T) {
+	_, err := ParseModule("(def x 5)\n(print (+ x 1)\n", "test.glisp")
+	if err == nil {
+		t.Fatal("Unbalanced parentheses must fail to parse")
+	}
+
+	parseError, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expected a ParseError, found %T", err)
+	}
+
+	if parseError.File != "test.glisp" || parseError.Line != 2 || parseError.Column != 1 {
+		t.Errorf("Wrong error position: %s", parseError.Error())
+	}
+
+	if _, err := EvaluateString("(print \"unterminated)", MainContext); err == nil {
+		t.Error("Unterminated strings must fail to parse")
+	}
+}
+
+func TestStackTrace(t *testing.T) {
+	code, err := ParseModule("(defn| fails [0] (undefined-function))\n(defn| fails [n] (fails (- n 1)))\n(fails 1)", "trace.glisp")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = Evaluate(code, MainContext)
+	runtimeError, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("Expected a RuntimeError, found %v", err)
+	}
+
+	if runtimeError.Pos == nil || runtimeError.Pos.Line != 1 || runtimeError.Pos.Column != 18 {
+		t.Errorf("Wrong error position in %s", runtimeError.Error())
+	}
+
+	if len(runtimeError.Stack) != 2 || runtimeError.Stack[0].Dispatch != "[0]" || runtimeError.Stack[1].Dispatch != "[n]" {
+		t.Errorf("Wrong stack trace %s", runtimeError.Error())
+	}
+}
+
+// Tail calls replace the frames of their callers, which are summarised in the stack trace
+func TestTailCallStackTrace(t *testing.T) {
+	code, err := ParseModule("(defn| counts [0] (undefined-function))\n(defn| counts [n] (counts (- n 1)))\n(counts 5)", "trace.glisp")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = Evaluate(code, MainContext)
+	runtimeError, ok := err.(*RuntimeError)
+	if !ok {
+		t.Fatalf("Expected a RuntimeError, found %v", err)
+	}
+
+	// (counts 0) failed, (counts 5) was called first, and the calls in between were left out
+	stack := runtimeError.Stack
+	if len(stack) != 3 || stack[0].Dispatch != "[0]" || stack[1].Function != "..." || stack[2].Dispatch != "[n]" {
+		t.Fatalf("Wrong stack trace %s", runtimeError.Error())
+	}
+
+	if stack[1].Dispatch != "(4 tail calls)" || stack[2].Pos == nil || stack[2].Pos.Line != 2 {
+		t.Errorf("Wrong stack trace %s", runtimeError.Error())
+	}
+}
+
+func TestTryCatch(t *testing.T) {
+	tests := map[string]string{
+		"(try (throw \"boom\") (catch e (error-message e)))":                           "\"boom\"",
+		"(try (+ 1 2) (catch e 0))":                                                    "3",
+		"(try (undefined-function) (catch e (type e)))":                                "Error",
+		"(try (throw \"x\" {:code 7}) (catch e (get (error-data e) :code)))":           "7",
+		"(try (try (throw \"inner\") (finally (def cleaned true))) (catch e cleaned))": "true",
+	}
+
+	for code, expected := range tests {
+		result, err := EvaluateString(code, MainContext)
+		if err != nil {
+			t.Errorf("%s failed: %s", code, err.Error())
+			continue
+		}
+
+		if result.String() != expected {
+			t.Errorf("%s: expected %s, found %s", code, expected, result.String())
+		}
+	}
+
+	if _, err := EvaluateString("(throw \"uncaught\")", MainContext); err == nil || err.(*RuntimeError).Message != "uncaught" {
+		t.Errorf("Uncaught errors must be returned by Evaluate, found %v", err)
+	}
+}
+
+func TestFailingFinally(t *testing.T) {
+	tests := map[string]string{
+		// the error of the cleanup must not replace the error thrown by the body
+		"(try (try (throw \"body\") (finally (throw \"cleanup\"))) (catch e (error-message e)))": "\"body\"",
+		"(try (try (+ 1 2) (finally (throw \"cleanup\"))) (catch e (error-message e)))":          "\"cleanup\"",
+	}
+
+	for code, expected := range tests {
+		result, err := EvaluateString(code, MainContext)
+		if err != nil {
+			t.Errorf("%s failed: %s", code, err.Error())
+			continue
+		}
+
+		if result.String() != expected {
+			t.Errorf("%s: expected %s, found %s", code, expected, result.String())
+		}
+	}
+}
+
+// Functions are lexically scoped by the context they have been defined in
+func TestClosures(t *testing.T) {
+	code := `
+		(defn make-adder [n] #(+ n %))
+		(def add5 (make-adder 5))
+
+		(defn make-counter [] (let [state {:n 0}] (fn [] (put state :n (+ (get state :n) 1)))))
+		(def counter (make-counter))
+		(def other-counter (make-counter))
+
+		(def from-let (let [x 42] #(+ x %)))
+
+		(defn get-free-variable [] free-variable)
+		(defn with-free-variable [free-variable] (get-free-variable))`
+
+	module, err := ParseModule(code, "closures.glisp")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	context := NewContext()
+	context.parent = MainContext
+	if _, err := Evaluate(module, context); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := map[string]string{
+		"(add5 10)":                "15",
+		"((make-adder 1) 1)":       "2",
+		"(do (counter) (counter))": "2",
+		"(other-counter)":          "1",
+		"(from-let 1)":             "43",
+		"(try (with-free-variable 1) (catch e :unbound))": ":unbound",
+	}
+
+	for expr, expected := range tests {
+		result, err := EvaluateString(expr, context)
+		if err != nil {
+			t.Errorf("%s failed: %s", expr, err.Error())
+			continue
+		}
+
+		if result.String() != expected {
+			t.Errorf("%s: expected %s, found %s", expr, expected, result.String())
+		}
+	}
+}
+
+// Calls in tail position must not grow the stack
+func TestTailCalls(t *testing.T) {
+	code := `(do
+		(defn| count-down [0] :done)
+		(defn| count-down [n] (do (+ n 1) (let [m (- n 1)] (if (> m -1) (count-down m) :never)))))`
+
+	if _, err := EvaluateString(code, MainContext); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	debug.SetMaxStack(1 << 20)
+	defer debug.SetMaxStack(1 << 30)
+
+	result, err := EvaluateString("(count-down 100000)", MainContext)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if result.String() != ":done" {
+		t.Errorf("Expected :done, found %s", result.String())
+	}
+}
+
+func TestMacros(t *testing.T) {
+	tests := map[string]string{
+		"'x":                               "x",
+		"'(1 2 x)":                         "(1 2 x)",
+		"(let [x 5] `(+ ~x 1))":            "(+ 5 1)",
+		"(let [xs [1 2]] `(+ ~@xs 3))":     "(+ 1 2 3)",
+		"(when true 1 2)":                  "2",
+		"(unless true 1)":                  "Nothing",
+		"(cond false 1 (> 2 1) 2 :else 3)": "2",
+		"(cond false 1 :else 3)":           "3",
+		"(-> 5 (- 1) (* 2))":               "8",
+		"(macroexpand '(when c x))":        "(if c (do x))",
+		"(do (defmacro twice [expr] `(do ~expr ~expr)) (let [state {:n 0}] (twice (put state :n (+ (get state :n) 1)))))": "2",
+		"(do (defn count-args [& xs] (len xs)) [(count-args) (count-args 1 2 3)])":                                        "[0 3]",
+		"(map #(str %) '(a b))": "(\"a\" \"b\")",
+	}
+
+	for code, expected := range tests {
+		result, err := EvaluateString(code, MainContext)
+		if err != nil {
+			t.Errorf("%s failed: %s", code, err.Error())
+			continue
+		}
+
+		if result.String() != expected {
+			t.Errorf("%s: expected %s, found %s", code, expected, result.String())
+		}
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	code := `
+		(defn describe [0] :zero)
+		(defn| describe [(x Int)] :int)
+		(defn| describe ["zero"] :zero-string)
+		(defn| describe [x] :any)
+		(defn| describe [x y] :pair)
+		(defn| describe [] :none)
+
+		(defn first-wins [x] :first)
+		(defn| first-wins [1] :second)
+
+		(defn count-args [(x String) & args] :string)
+		(defn| count-args [& args] (len args))
+
+		(defn nested [a] (let [b (+ a 1)] (fn [c] (let [a (* a 10)] (+ a b c)))))
+
+		(defn twice-later [x] (later-macro x))
+		(defmacro later-macro [x] (quasiquote (+ ~x ~x)))`
+
+	module, err := ParseModule(code, "dispatch.glisp")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	context := NewContext()
+	context.parent = MainContext
+	if _, err := Evaluate(module, context); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := map[string]string{
+		"(describe 0)":                        ":zero",
+		"(describe 0.0)":                      ":zero",
+		"(describe 5)":                        ":int",
+		"(describe 5.5)":                      ":any",
+		"(describe \"zero\")":                 ":zero-string",
+		"(describe 1 2)":                      ":pair",
+		"(describe)":                          ":none",
+		"(first-wins 1)":                      ":first",
+		"(count-args 1 2 3)":                  "3",
+		"(count-args)":                        "0",
+		"(count-args \"a\" 1)":                ":string",
+		"((nested 1) 100)":                    "112",
+		"(twice-later 21)":                    "42",
+		"(let [x 1 x 2] x)":                   "2",
+		"(let [x 1] (let [y 2] (def x 5) x))": "5",
+	}
+
+	for expr, expected := range tests {
+		result, err := EvaluateString(expr, context)
+		if err != nil {
+			t.Errorf("%s failed: %s", expr, err.Error())
+			continue
+		}
+
+		if result.String() != expected {
+			t.Errorf("%s: expected %s, found %s", expr, expected, result.String())
+		}
+	}
+}
+
+func TestVectors(t *testing.T) {
+	tests := map[string]string{
+		"(type [1 2 3])":                              "Vector",
+		"(type (list 1 2 3))":                         "List",
+		"(get [1 2 3] 1)":                             "2",
+		"(get [1 2 3] -1)":                            "3",
+		"(get [1 2 3] 5)":                             "Nothing",
+		"(let [v [1 2 3]] (do (put v 0 :x) v))":       "[:x 2 3]",
+		"(slice [1 2 3 4] 1 3)":                       "[2 3]",
+		"(slice [1 2 3 4] -2)":                        "[3 4]",
+		"(len [1 2 3])":                               "3",
+		"(map #(* % 2) [1 2 3])":                      "[2 4 6]",
+		"(filter #(> % 1) [1 2 3])":                   "[2 3]",
+		"(append [1] 2 [3 4] (list 5))":               "[1 2 3 4 5]",
+		"(prepend [3] 2 [0 1])":                       "[0 1 2 3]",
+		"(+ [1 2] [3 4])":                             "[1 2 3 4]",
+		"(first [1 2 3])":                             "1",
+		"(last [1 2 3])":                              "3",
+		"(apply + [1 2 3])":                           "6",
+		"(= [1 2 3] (list 1 2 3))":                    "true",
+		"(= [1 2 3] [1 2])":                           "false",
+		"(get (list 1 2 3) 1)":                        "2",
+		"(let [xs (list 1 2)] (do (put xs 1 :y) xs))": "[1 :y]",
+	}
+
+	for expr, expected := range tests {
+		result, err := EvaluateString(expr, MainContext)
+		if err != nil {
+			t.Errorf("%s failed: %s", expr, err.Error())
+			continue
+		}
+
+		if result.String() != expected {
+			t.Errorf("%s: expected %s, found %s", expr, expected, result.String())
+		}
+	}
+}
+
+func TestPersistentVector(t *testing.T) {
+	versions := []PersistentVector{CreatePersistentVector()}
+	for i := 0; i < 3000; i++ {
+		versions = append(versions, versions[i].Conj(Int{i}))
+	}
+
+	last := versions[len(versions)-1]
+	for i := 0; i < last.Len(); i++ {
+		if !last.Get(i).Equals(Int{i}) {
+			t.Fatalf("Expected %d at index %d, found %s", i, i, last.Get(i).String())
+		}
+	}
+
+	// older versions must remain unchanged
+	if versions[40].Len() != 40 || !versions[40].Get(39).Equals(Int{39}) {
+		t.Errorf("Version 40 has been modified: %s", versions[40].String())
+	}
+
+	changed := last.Assoc(1000, String{"x"}).Assoc(2999, String{"y"})
+	if !changed.Get(1000).Equals(String{"x"}) || !changed.Get(2999).Equals(String{"y"}) {
+		t.Errorf("Assoc failed")
+	}
+	if !last.Get(1000).Equals(Int{1000}) || !last.Get(2999).Equals(Int{2999}) {
+		t.Errorf("Assoc modified the original vector")
+	}
+}
+
+func TestPersistentMap(t *testing.T) {
+	m := CreatePersistentMap()
+	for i := 0; i < 5000; i++ {
+		m = m.Assoc(Int{i}, Int{i * i})
+	}
+
+	removed := m
+	for i := 0; i < 5000; i += 2 {
+		removed = removed.Dissoc(Int{i})
+	}
+
+	if m.Len() != 5000 || removed.Len() != 2500 {
+		t.Fatalf("Expected 5000 and 2500 entries, found %d and %d", m.Len(), removed.Len())
+	}
+
+	for i := 0; i < 5000; i++ {
+		if value, ok := m.Get(Int{i}); !ok || !value.Equals(Int{i * i}) {
+			t.Fatalf("Entry %d missing", i)
+		}
+
+		if _, ok := removed.Get(Int{i}); ok != (i%2 == 1) {
+			t.Fatalf("Entry %d should be removed: %t", i, i%2 == 0)
+		}
+	}
+}
+
+func TestPersistentCollections(t *testing.T) {
+	tests := map[string]string{
+		"(assoc (persistent-vector 1 2 3) 0 :x)":                                  "[:x 2 3]",
+		"(let [v (persistent-vector 1 2)] (do (assoc v 0 :x) v))":                 "[1 2]",
+		"(conj (persistent-vector 1 2) 3 4)":                                      "[1 2 3 4]",
+		"(get (assoc (persistent-map) :a 1 :b 2) :b)":                             "2",
+		"(len (dissoc (persistent-map :a 1 :b 2) :a))":                            "1",
+		"(contains? (conj (persistent-set) 1 2 2) 2)":                             "true",
+		"(len (conj (persistent-set) 1 2 2))":                                     "2",
+		"(contains? (dissoc (persistent-set 1 2) 2) 2)":                           "false",
+		"(get-in (persistent {:pos [1 2 3]}) [:pos 1])":                           "2",
+		"(get-in (update-in (persistent {:pos [1 2 3]}) [:pos 1] + 10) [:pos 1])": "12",
+		"(get-in (update-in (persistent-map) [:a :b] #(do % 5)) [:a :b])":         "5",
+		"(= (persistent [1 2]) [1 2])":                                            "true",
+		"(= (persistent-map :a 1) (persistent-map :a 1))":                         "true",
+		"(get (persistent-map [0 0 0] :stone) [0 0 0])":                           ":stone",
+		"(type (persistent {:a 1}))":                                              "PersistentMap",
+	}
+
+	for expr, expected := range tests {
+		result, err := EvaluateString(expr, MainContext)
+		if err != nil {
+			t.Errorf("%s failed: %s", expr, err.Error())
+			continue
+		}
+
+		if result.String() != expected {
+			t.Errorf("%s: expected %s, found %s", expr, expected, result.String())
+		}
+	}
+}
+
+func TestDictKeys(t *testing.T) {
+	tests := map[string]string{
+		"(get {[0 0 0] :stone} [0 0 0])":                        ":stone",
+		"(get {(list 1 2) :list} [1 2])":                        ":list",
+		"(get {{:a 1 :b 2} :dict} {:b 2 :a 1})":                 ":dict",
+		"(get {{:a 1 :b 2} :dict} {:a 1})":                      "Nothing",
+		"(get {1 :one} 1.0)":                                    ":one",
+		"(get {(* 3000 1000000) :big} 3000000000.0)":            ":big",
+		"(get {-3000000000.0 :big} (* -3000 1000000))":          ":big",
+		"(get {(persistent [1 2]) :p} [1 2])":                   ":p",
+		"(let [d {}] (do (put d [1 2] :a) (put d [1 2] :b) d))": "{[1 2] :b}",
+		"(len {[1] 1 [1] 2})":                                   "1",
+		"(contains? (persistent-set [0 1] [1 0]) [1 0])":        "true",
+	}
+
+	for expr, expected := range tests {
+		result, err := EvaluateString(expr, MainContext)
+		if err != nil {
+			t.Errorf("%s failed: %s", expr, err.Error())
+			continue
+		}
+
+		if result.String() != expected {
+			t.Errorf("%s: expected %s, found %s", expr, expected, result.String())
+		}
+	}
+}
+
+func TestHashTable(t *testing.T) {
+	dict := CreateDict()
+	for i := 0; i < 100; i++ {
+		dict.Put(MakeVector(Int{i}, Int{i}), Int{i})
+	}
+	for i := 0; i < 100; i += 3 {
+		if !dict.Remove(MakeVector(Int{i}, Int{i})) {
+			t.Fatalf("Entry %d could not be removed", i)
+		}
+	}
+
+	if dict.Len() != 66 {
+		t.Fatalf("Expected 66 entries, found %d", dict.Len())
+	}
+
+	// entries are iterated in insertion order
+	previous := -1
+	dict.Foreach(func(key Data, value Data) {
+		i := value.(Int).Value
+		if i <= previous || i%3 == 0 {
+			t.Errorf("Unexpected entry %d after %d", i, previous)
+		}
+		previous = i
+
+		if found, ok := dict.Get(MakeVector(Int{i}, Int{i})); !ok || !found.Equals(value) {
+			t.Errorf("Entry %d not found", i)
+		}
+	})
+}
+
+func TestEventArguments(t *testing.T) {
+	code := `(do
+		(defevent TestMove :dir :speed)
+		(def test-source (entity))
+		(defn test-on-move [entity args] (get args :dir))
+		(defn test-on-move-destructured [entity dir speed] (str dir speed)))`
+
+	if _, err := EvaluateString(code, MainContext); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	def := MainContext.LookUp(Symbol{Value: "TestMove"}).(*UserEventDefinition)
+	handlers := map[string]string{"test-on-move": "\"forward\"", "test-on-move-destructured": "\"forward2\""}
+
+	for _, args := range []List{MakeList(String{"forward"}, Int{2}),
+		MakeList(Keyword{":speed"}, Int{2}, Keyword{":dir"}, String{"forward"})} {
+		for name, expected := range handlers {
+			fn := MainContext.LookUp(Symbol{Value: name}).(*Function)
+			handler := &UserEventHandler{Owner: NewEntity(), Handler: fn}
+			result := fn.Apply(handler.arguments(&UserEvent{def, def.BindArguments(args)}))
+
+			if result.String() != expected {
+				t.Errorf("%s %s: expected %s, found %s", name, args.String(), expected, result.String())
+			}
+		}
+	}
+
+	invalid := []string{
+		"(trigger test-source TestMove \"forward\")",
+		"(trigger test-source TestMove \"forward\" 2 3)",
+		"(trigger test-source TestMove :dir \"forward\")",
+		"(trigger test-source TestMove :dir \"forward\" :jump 2)",
+		"(trigger test-source TestMove :dir \"forward\" :dir \"back\")",
+	}
+
+	for _, expr := range invalid {
+		if _, err := EvaluateString(expr, MainContext); err == nil {
+			t.Errorf("%s should have failed", expr)
+		}
+	}
+}
+
+func TestSynchronousEvents(t *testing.T) {
+	SynchronousEvents = true
+	context := CreateMainContext()
+	SynchronousEvents = false
+
+	code := `(do
+		(defevent TestPing :n)
+		(def test-log [])
+		(def test-a (entity))
+		(def test-b (entity))
+		(on TestPing (fn [entity n] (append test-log n)))
+		(subscribe test-a :to TestPing :by test-b :handler (fn [entity n] (append test-log (* n 10))))
+		(trigger test-a TestPing 1)
+		(trigger test-b TestPing 2)
+		(trigger test-a TestPing 3))`
+
+	if _, err := EvaluateString(code, context); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	log := context.LookUp(Symbol{Value: "test-log"})
+	if log.String() != "[]" {
+		t.Errorf("Events were delivered before dispatching: %s", log.String())
+	}
+
+	context.GetEventBus().Dispatch()
+	if log.String() != "[1 2 20 3]" {
+		t.Errorf("Expected [1 2 20 3], found %s", log.String())
+	}
+
+	context.GetEventBus().Shutdown()
+}
+
+func TestUnsubscribe(t *testing.T) {
+	SynchronousEvents = true
+	context := CreateMainContext()
+	SynchronousEvents = false
+
+	code := `(do
+		(defevent TestPing :n)
+		(def test-log [])
+		(def test-a (entity))
+		(def test-b (entity))
+		(defn test-log-ping [entity n] (append test-log n))
+		(def test-sub (on TestPing (fn [entity n] (append test-log (* n 10)))))
+		(subscribe test-a :to TestPing :handler test-log-ping)
+		(subscribe test-b :to TestPing :handler test-log-ping)
+		(subscribe test-b :to TestPing :by test-a :handler test-log-ping))`
+
+	steps := []struct{ code, expected string }{
+		{"(trigger test-a TestPing 1)", "[10 1 1 1]"},
+		{"(unsubscribe test-sub)", "[]"},
+		{"(trigger test-a TestPing 2)", "[2 2 2]"},
+		{"(unsubscribe test-b :to TestPing :handler test-log-ping)", "[]"},
+		{"(trigger test-a TestPing 3)", "[3 3]"},
+		{"(unsubscribe-all test-b)", "[]"},
+		{"(trigger test-a TestPing 4)", "[4]"},
+		{"(unsubscribe test-a :to TestPing)", "[]"},
+		{"(trigger test-a TestPing 5)", "[]"},
+	}
+
+	if _, err := EvaluateString(code, context); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, step := range steps {
+		log := context.LookUp(Symbol{Value: "test-log"}).(Vector)
+		*log.items = (*log.items)[:0]
+
+		if _, err := EvaluateString(step.code, context); err != nil {
+			t.Fatal(err.Error())
+		}
+		context.GetEventBus().Dispatch()
+
+		if log.String() != step.expected {
+			t.Errorf("%s: expected %s, found %s", step.code, step.expected, log.String())
+		}
+	}
+
+	context.GetEventBus().Shutdown()
+}
+
+func TestEventPriorities(t *testing.T) {
+	SynchronousEvents = true
+	context := CreateMainContext()
+	SynchronousEvents = false
+
+	code := `(do
+		(defevent TestKey :key)
+		(def test-log [])
+		(def test-ui (entity))
+		(on TestKey (fn [entity key] (append test-log (str "game " key))))
+		(on TestKey (fn [entity key] (append test-log (str "debug " key))) -1)
+		(subscribe test-ui :to TestKey :priority 10 :handler (fn [entity key]
+			(do (append test-log (str "ui " key)) (if (== key "esc") (consume-event) Nothing))))
+		(trigger test-ui TestKey "w")
+		(trigger test-ui TestKey "esc"))`
+
+	if _, err := EvaluateString(code, context); err != nil {
+		t.Fatal(err.Error())
+	}
+	context.GetEventBus().Dispatch()
+
+	expected := `["ui w" "game w" "debug w" "ui esc"]`
+	if log := context.LookUp(Symbol{Value: "test-log"}); log.String() != expected {
+		t.Errorf("Expected %s, found %s", expected, log.String())
+	}
+
+	context.GetEventBus().Shutdown()
+}
+
+func TestEventRecording(t *testing.T) {
+	code := `(do
+		(defevent TestInput :key :data)
+		(def test-log [])
+		(def test-player (entity))
+		(on TestInput (fn [entity key data] (append test-log [key data]))))`
+
+	path := os.TempDir() + "/apollo-test-events.glisp"
+	defer os.Remove(path)
+
+	// record some events
+	SynchronousEvents = true
+	context := CreateMainContext()
+	if _, err := EvaluateString(code, context); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	recording, err := NewEventRecording(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	context.GetEventBus().SetRecorder(recording)
+
+	// strings must not break the lines of the recording
+	quoted := String{"say \"hi\"\nto C:\\"}
+	context.Define(Symbol{Value: "test-quoted"}, quoted)
+
+	triggers := []string{
+		`(trigger test-player TestInput "w" {:pos [1 2.0] :target test-player})`,
+		`(trigger test-player TestInput :key "s" :data (list true Nothing :fast))`,
+		`(trigger test-player TestInput test-quoted [test-quoted])`,
+	}
+	for frame, trigger := range triggers {
+		recording.SetFrame(frame + 1)
+		if _, err := EvaluateString(trigger, context); err != nil {
+			t.Fatal(err.Error())
+		}
+		context.GetEventBus().Dispatch()
+	}
+
+	recording.Close()
+	expected := context.LookUp(Symbol{Value: "test-log"}).String()
+	context.GetEventBus().Shutdown()
+
+	recorded, err := ReadEventRecording(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(recorded) != 3 || recorded[1].Frame != 2 || recorded[1].Event != "TestInput" || recorded[1].Source == 0 {
+		t.Fatalf("Unexpected recording %v", recorded)
+	}
+	if key := recorded[2].Arguments.GetOrDefault(Keyword{":key"}, nil); key != quoted {
+		t.Fatalf("Expected %q, found %v", quoted.Value, key)
+	}
+
+	// replay them into a fresh context, the events triggered by the script itself are dropped
+	context = CreateMainContext()
+	SynchronousEvents = false
+	if _, err := EvaluateString(code, context); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	replay := NewEventReplay(recorded, context.GetEventBus(), context)
+	for frame := 1; !replay.Done(); frame++ {
+		EvaluateString(`(trigger test-player TestInput "x" 0)`, context)
+		if err := replay.Replay(frame); err != nil {
+			t.Fatal(err.Error())
+		}
+		context.GetEventBus().Dispatch()
+	}
+
+	if log := context.LookUp(Symbol{Value: "test-log"}).String(); log != expected {
+		t.Errorf("Expected %s, found %s", expected, log)
+	}
+
+	context.GetEventBus().Shutdown()
+}
+
+func TestEventPatterns(t *testing.T) {
+	SynchronousEvents = true
+	context := CreateMainContext()
+	SynchronousEvents = false
+
+	code := `(do
+		(defevent Input/KeyDown :key)
+		(defevent Input/Mouse/Move :x :y)
+		(defevent Game/Over)
+		(def test-log [])
+		(def test-source (entity))
+		(on Input/KeyDown (fn [entity key] (append test-log key)))
+		(on "Input/*" (fn [entity event args] (append test-log (str "input " event))) 1)
+		(def test-all (on "*" (fn [entity event args] (append test-log (str "all " event))) -1))
+		(trigger test-source Input/KeyDown "w")
+		(trigger test-source Input/Mouse/Move 1 2)
+		(trigger test-source Game/Over))`
+
+	if _, err := EvaluateString(code, context); err != nil {
+		t.Fatal(err.Error())
+	}
+	context.GetEventBus().Dispatch()
+
+	expected := `["input Event<Input/KeyDown>" "w" "all Event<Input/KeyDown>" ` +
+		`"input Event<Input/Mouse/Move>" "all Event<Input/Mouse/Move>" "all Event<Game/Over>"]`
+	log := context.LookUp(Symbol{Value: "test-log"}).(Vector)
+	if log.String() != expected {
+		t.Errorf("Expected %s, found %s", expected, log.String())
+	}
+
+	*log.items = (*log.items)[:0]
+	if _, err := EvaluateString("(do (unsubscribe test-all) (trigger test-source Game/Over))", context); err != nil {
+		t.Fatal(err.Error())
+	}
+	context.GetEventBus().Dispatch()
+
+	if log.String() != "[]" {
+		t.Errorf("Expected [], found %s", log.String())
+	}
+
+	context.GetEventBus().Shutdown()
+}
+
+func TestComponents(t *testing.T) {
+	code := `(do
+		(def test-e1 (add-component (entity) :test-pos [0 0]))
+		(def test-e2 (-> (entity) (add-component :test-pos [1 1]) (add-component :test-vel [1 0])))
+		(def test-e3 (-> (entity) (add-component :test-pos [2 2]) (add-component :test-vel [0 1]))))`
+
+	if _, err := EvaluateString(code, MainContext); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the tests run in order, as some of them change the components
+	tests := []struct{ expr, expected string }{
+		{"(get-component test-e2 :test-vel)", "[1 0]"},
+		{"(get-component test-e1 :test-vel)", "Nothing"},
+		{"(get-component test-e1 :test-vel 0)", "0"},
+		{"(has-component? test-e1 :test-pos)", "true"},
+		{"(len (query :test-pos))", "3"},
+		{"(== (query :test-vel :test-pos) (list test-e2 test-e3))", "true"},
+		{"(len (query :test-pos :test-unknown))", "0"},
+		{"(do (remove-component test-e2 :test-pos) (len (query :test-pos)))", "2"},
+		{"(== (query :test-pos :test-vel) (list test-e3))", "true"},
+		{"(get-component (add-component test-e3 :test-vel 5) :test-vel)", "5"},
+	}
+
+	for _, test := range tests {
+		expr, expected := test.expr, test.expected
+		result, err := EvaluateString(expr, MainContext)
+		if err != nil {
+			t.Errorf("%s failed: %s", expr, err.Error())
+			continue
+		}
+
+		if result.String() != expected {
+			t.Errorf("%s: expected %s, found %s", expr, expected, result.String())
+		}
+	}
+}
+
+func TestSystems(t *testing.T) {
+	code := `(do
+		(def test-sys-log [])
+		(def test-mover (-> (entity) (add-component :test-sys-pos 0) (add-component :test-sys-vel 2)))
+		(defsystem test-move [:test-sys-pos :test-sys-vel] :phase :physics (fn [e dt]
+			(do
+				(add-component e :test-sys-pos (+ (get-component e :test-sys-pos) (* (get-component e :test-sys-vel) dt)))
+				(append test-sys-log "move"))))
+		(defsystem test-input [] :phase :input (fn [dt] (append test-sys-log "input")))
+		(defsystem test-late [] :order 1 (fn [dt] (append test-sys-log "late")))
+		(defsystem test-early [] :order -1 (fn [dt] (append test-sys-log "early")))
+		(defsystem test-failing [] (fn [dt] (undefined-function dt))))`
+
+	if _, err := EvaluateString(code, MainContext); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	systemScheduler.Run(0.5)
+
+	log := MainContext.LookUp(Symbol{Value: "test-sys-log"}).(Vector)
+	if expected := `["input" "early" "late" "move"]`; log.String() != expected {
+		t.Errorf("Expected %s, found %s", expected, log.String())
+	}
+
+	if system := systemScheduler.Get("test-failing"); system == nil || system.Enabled {
+		t.Errorf("Failing system has not been disabled")
+	}
+
+	*log.items = (*log.items)[:0]
+	if _, err := EvaluateString("(do (disable-system test-input) (disable-system test-early))", MainContext); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	systemScheduler.Run(0.5)
+	if expected := `["late" "move"]`; log.String() != expected {
+		t.Errorf("Expected %s, found %s", expected, log.String())
+	}
+
+	if pos, _ := EvaluateString("(get-component test-mover :test-sys-pos)", MainContext); pos.String() != "2" {
+		t.Errorf("Expected position 2, found %s", pos.String())
+	}
+
+	// the systems must not run in other tests
+	for _, name := range []string{"test-move", "test-late"} {
+		systemScheduler.SetEnabled(systemScheduler.Get(name), false)
+	}
+}
+
+func TestTraits(t *testing.T) {
+	SynchronousEvents = true
+	context := CreateMainContext()
+	SynchronousEvents = false
+
+	code := `(do
+		(defevent TestDamage :amount)
+		(defn test-on-damage [e amount] (add-component e :health (- (get-component e :health) amount)))
+		(deftrait TestHealth
+			(properties :health 100 :max-health 100)
+			(on (TestDamage test-on-damage)))
+		(deftrait TestPosition (properties :pos [0 0]))
+		(def test-a (create-entity TestHealth TestPosition))
+		(def test-b (create-entity (TestHealth 50) (TestPosition :pos [1 1])))
+		(def test-c (create-entity (TestHealth :max-health 200)))
+		(put (get-component test-a :pos) 0 5)
+		(trigger test-a TestDamage 10))`
+
+	if _, err := EvaluateString(code, context); err != nil {
+		t.Fatal(err.Error())
+	}
+	context.GetEventBus().Dispatch()
+
+	// redefining the trait updates the defaults that haven't been overridden or changed
+	redefinition := `(deftrait TestHealth
+		(properties :health 150 :max-health 150 :armor 1)
+		(on (TestDamage test-on-damage)))`
+	if _, err := EvaluateString(redefinition, context); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct{ expr, expected string }{
+		{"(get-component test-a :health)", "90"},
+		{"(get-component test-a :max-health)", "150"},
+		{"(get-component test-a :armor)", "1"},
+		{"(get-component test-a :pos)", "[5 0]"},
+		{"(get-component test-b :health)", "50"},
+		{"(get-component test-b :pos)", "[1 1]"},
+		{"(get-component test-c :health)", "150"},
+		{"(get-component test-c :max-health)", "200"},
+		{"(do (trigger test-c TestDamage 5) Nothing)", "Nothing"},
+	}
+
+	for _, test := range tests {
+		result, err := EvaluateString(test.expr, context)
+		if err != nil {
+			t.Errorf("%s failed: %s", test.expr, err.Error())
+			continue
+		}
+
+		if result.String() != test.expected {
+			t.Errorf("%s: expected %s, found %s", test.expr, test.expected, result.String())
+		}
+	}
+
+	// handlers have been resubscribed once
+	context.GetEventBus().Dispatch()
+	if result, _ := EvaluateString("(get-component test-c :health)", context); result.String() != "145" {
+		t.Errorf("Expected health 145, found %s", result.String())
+	}
+
+	if _, err := EvaluateString("(create-entity (TestHealth :speed 1 :health 5))", context); err == nil {
+		t.Errorf("Unknown property has been accepted")
+	}
+
+	context.GetEventBus().Shutdown()
+}
+
+func TestDestroyEntities(t *testing.T) {
+	SynchronousEvents = true
+	context := CreateMainContext()
+	SynchronousEvents = false
+
+	code := `(do
+		(def test-destroyed (vector))
+		(def test-a (add-component (entity) :test-hp 10))
+		(def test-b (add-component (entity) :test-hp 20))
+		(defevent TestPing)
+		(subscribe test-a :to TestPing :handler (fn [e args] (append test-destroyed :pinged)))
+		(on Destroyed (fn [e entity] (append test-destroyed entity)))
+		(def test-watched (vector))
+		(def test-watcher (entity))
+		(subscribe test-watcher :to TestPing :by test-a :handler (fn [e args] (append test-watched :pinged)))
+		(subscribe test-watcher :to Destroyed :by test-a :handler (fn [e entity] (append test-watched :destroyed)))
+		(def test-cleaned-up (vector))
+		(defn test-cleanup [e entity] (append test-cleaned-up entity))
+		(deftrait TestMortal (properties :test-lives 1) (on (Destroyed test-cleanup)))
+		(def test-mortal (create-entity TestMortal)))`
+
+	if _, err := EvaluateString(code, context); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct{ expr, expected string }{
+		{"(alive? test-a)", "true"},
+		{"(destroy test-a)", "true"},
+		{"(destroy test-a)", "false"},
+		{"(alive? test-a)", "false"},
+		{"(alive? test-b)", "true"},
+		{"(get-component test-a :test-hp)", "Nothing"},
+		{"(= (query :test-hp) [test-b])", "true"},
+		{"(do (def test-c (entity)) Nothing)", "Nothing"},
+		{"(= test-a test-c)", "false"},
+		{"(alive? test-c)", "true"},
+		{"(get-component test-c :test-hp)", "Nothing"},
+	}
+
+	for _, test := range tests {
+		result, err := EvaluateString(test.expr, context)
+		if err != nil {
+			t.Errorf("%s failed: %s", test.expr, err.Error())
+			continue
+		}
+
+		if result.String() != test.expected {
+			t.Errorf("%s: expected %s, found %s", test.expr, test.expected, result.String())
+		}
+	}
+
+	if _, err := EvaluateString("(add-component test-a :test-hp 1)", context); err == nil {
+		t.Errorf("Components have been added to a destroyed entity")
+	}
+
+	// the destroyed entity doesn't receive events anymore, and others only receive its Destroyed event
+	if _, err := EvaluateString("(do (trigger test-b TestPing) (trigger test-a TestPing))", context); err != nil {
+		t.Fatal(err.Error())
+	}
+	context.GetEventBus().Dispatch()
+
+	result, _ := EvaluateString("(= test-destroyed [test-a])", context)
+	if result.String() != "true" {
+		t.Errorf("Expected [test-a], found %s", context.LookUp(Symbol{Value: "test-destroyed"}).String())
+	}
+
+	if watched := context.LookUp(Symbol{Value: "test-watched"}).String(); watched != "[:destroyed]" {
+		t.Errorf("Expected [:destroyed], found %s", watched)
+	}
+	if handlers := FindSourceEventHandlers(context.LookUp(Symbol{Value: "test-a"}).(*Entity)); len(handlers) != 0 {
+		t.Errorf("Subscriptions to the destroyed entity remain: %v", handlers)
+	}
+
+	// destroyed entities leave their traits
+	if _, err := EvaluateString("(destroy test-mortal)", context); err != nil {
+		t.Fatal(err.Error())
+	}
+	if members := context.LookUp(Symbol{Value: "TestMortal"}).(*Trait).members; len(members) != 0 {
+		t.Errorf("Destroyed entity is still a member of its trait")
+	}
+
+	// but they receive their own Destroyed event before their subscriptions end
+	context.GetEventBus().Dispatch()
+	result, _ = EvaluateString("(= test-cleaned-up [test-mortal])", context)
+	if result.String() != "true" {
+		t.Errorf("Expected [test-mortal], found %s", context.LookUp(Symbol{Value: "test-cleaned-up"}).String())
+	}
+	mortal := context.LookUp(Symbol{Value: "test-mortal"}).(*Entity)
+	if handlers := FindUserEventHandlers(mortal, "", nil, nil); len(handlers) != 0 {
+		t.Errorf("Subscriptions of the destroyed entity remain: %v", handlers)
+	}
+
+	context.GetEventBus().Shutdown()
+}
+
+func TestPropertyChanges(t *testing.T) {
+	SynchronousEvents = true
+	context := CreateMainContext()
+	SynchronousEvents = false
+
+	code := `(do
+		(def test-changes (vector))
+		(def test-player (add-component (entity) :health 100))
+		(def test-other (add-component (entity) :health 100)))`
+
+	if _, err := EvaluateString(code, context); err != nil {
+		t.Fatal(err.Error())
+	}
+	context.GetEventBus().Dispatch()
+
+	code = `(do
+		(on-change test-player :health (fn [e new old] (append test-changes (str old "->" new))))
+		(on-change test-other :health (fn [e health] (append test-changes health)))
+		(on PropertyChanged (fn [e property old new] (if (= property :mana) (append test-changes property) Nothing)))
+		(add-component test-player :health 90)
+		(add-component test-player :health 90)
+		(add-component test-player :mana 10)
+		(add-component test-other :health 50)
+		(remove-component test-player :health))`
+
+	if _, err := EvaluateString(code, context); err != nil {
+		t.Fatal(err.Error())
+	}
+	context.GetEventBus().Dispatch()
+
+	result, err := EvaluateString("test-changes", context)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// unchanged values and other properties or entities don't call the handler
+	if expected := `["100->90" :mana 50 "90->Nothing"]`; result.String() != expected {
+		t.Errorf("Expected %s, found %s", expected, result.String())
+	}
+
+	context.GetEventBus().Shutdown()
+}
+
+func TestHeadlessGamehost(t *testing.T) {
+	Headless = true
+	gameloop := MainContext.LookUp(Symbol{Value: "gameloop"})
+	defer func() {
+		Headless = false
+		MaxFrames = 0
+		MainContext.Define(Symbol{Value: "gameloop"}, gameloop)
+	}()
+
+	code := `(do
+		(def test-frames (vector))
+		(defn gameloop [dt] (append test-frames (len test-frames))))`
+	if _, err := EvaluateString(code, MainContext); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// runs a fixed number of frames
+	MaxFrames = 3
+	RunGamehost()
+
+	if result, _ := EvaluateString("test-frames", MainContext); result.String() != "[0 1 2]" {
+		t.Errorf("Expected 3 frames, found %s", result.String())
+	}
+
+	// runs until (quit)
+	MaxFrames = 0
+	code = `(do
+		(def test-frames (vector))
+		(defn gameloop [dt] (do (append test-frames (len test-frames)) (if (= (len test-frames) 5) (quit) Nothing))))`
+	if _, err := EvaluateString(code, MainContext); err != nil {
+		t.Fatal(err.Error())
+	}
+	RunGamehost()
+
+	if result, _ := EvaluateString("test-frames", MainContext); result.String() != "[0 1 2 3 4]" {
+		t.Errorf("Expected 5 frames, found %s", result.String())
+	}
+
+	// the gamehost can be run again after quitting
+	MaxFrames = 2
+	if _, err := EvaluateString("(def test-frames (vector))", MainContext); err != nil {
+		t.Fatal(err.Error())
+	}
+	RunGamehost()
+
+	if result, _ := EvaluateString("test-frames", MainContext); result.String() != "[0 1]" {
+		t.Errorf("Expected 2 frames after quitting, found %s", result.String())
+	}
+}
+
+func TestGameClock(t *testing.T) {
+	Headless = true
+	UpdateRate = 200
+	MaxFrames = 4
+	gameloop := MainContext.LookUp(Symbol{Value: "gameloop"})
+	defer func() {
+		Headless = false
+		UpdateRate = 60
+		MaxFrames = 0
+		MainContext.Define(Symbol{Value: "gameloop"}, gameloop)
+	}()
+
+	code := `(do
+		(def test-frames (vector))
+		(defn gameloop [dt] (append test-frames (frame-number) (= dt (delta-time)))))`
+	if _, err := EvaluateString(code, MainContext); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	RunGamehost()
+
+	tests := []struct{ expr, expected string }{
+		{"test-frames", "[1 true 2 true 3 true 4 true]"},
+		{"(frame-number)", "4"},
+		{"(delta-time)", "0.005"},
+		{"(elapsed-time)", "0.02"},
+	}
+
+	for _, test := range tests {
+		result, err := EvaluateString(test.expr, MainContext)
+		if err != nil {
+			t.Errorf("%s failed: %s", test.expr, err.Error())
+			continue
+		}
+
+		if result.String() != test.expected {
+			t.Errorf("%s: expected %s, found %s", test.expr, test.expected, result.String())
+		}
+	}
+
+	// headless games with a number of frames don't wait for the real time to pass
+	UpdateRate = 0.5
+	start := time.Now()
+	RunGamehost()
+
+	if duration := time.Since(start); duration > time.Second {
+		t.Errorf("Running 4 frames of 2 seconds took %v", duration)
+	}
+	if result, _ := EvaluateString("(elapsed-time)", MainContext); result.String() != "8" {
+		t.Errorf("Expected 8 seconds of game time, found %s", result.String())
+	}
+
+	for _, rate := range []float64{0, -60, 1e12} {
+		if _, err := updateStep(rate); err == nil {
+			t.Errorf("Update rate %v has been accepted", rate)
+		}
+	}
+}
+
+// Renders a small block world with the software renderer and compares it to testdata/cube_world.png
+func TestSoftwareRenderer(t *testing.T) {
+	world := NewWorld()
+	world.Create(CreateCube(0, 0, 0))
+	world.Create(CreateCube(1, 0, -1))
+	world.Create(CreateCube(-1.5, 0.5, -2))
+
+	renderer := NewSoftwareRenderer(160, 120)
+	renderer.SetClearColor(Color{1, 1, 1, 1})
+	renderer.BeginFrame()
+	world.Render(renderer)
+	renderer.EndFrame()
+
+	file, err := os.Open("testdata/cube_world.png")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer file.Close()
+
+	golden, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	frame := renderer.Image()
+	if !frame.Bounds().Eq(golden.Bounds()) {
+		t.Fatalf("Expected a frame of %v, found %v", golden.Bounds(), frame.Bounds())
+	}
+
+	// platforms with fused multiply-add round differently, which may change the colour of
+	// pixels at the edges of triangles
+	const tolerance = 2 * 0x101
+	maxDifferences := frame.Bounds().Dx() * frame.Bounds().Dy() / 200
+
+	similar := func(c1, c2 uint32) bool {
+		return c1 <= c2+tolerance && c2 <= c1+tolerance
+	}
+
+	differences := 0
+	for y := 0; y < frame.Bounds().Dy(); y++ {
+		for x := 0; x < frame.Bounds().Dx(); x++ {
+			r1, g1, b1, a1 := frame.At(x, y).RGBA()
+			r2, g2, b2, a2 := golden.At(x, y).RGBA()
+			if !similar(r1, r2) || !similar(g1, g2) || !similar(b1, b2) || !similar(a1, a2) {
+				differences++
+			}
+		}
+	}
+
+	if differences > maxDifferences {
+		path := filepath.Join(os.TempDir(), "cube_world.png")
+		renderer.SavePNG(path)
+		t.Errorf("%d pixels differ from testdata/cube_world.png, see %s", differences, path)
+	}
+}
+
+func TestSoftwareRendererDegenerateCamera(t *testing.T) {
+	world := NewWorld()
+	world.Create(CreateCube(0, 0, 0))
+
+	withoutFieldOfView := DefaultCamera()
+	withoutFieldOfView.FieldOfView = 0
+	withoutDepth := DefaultCamera()
+	withoutDepth.Near, withoutDepth.Far = 1, 1
+	orthographicWithoutDepth := withoutDepth
+	orthographicWithoutDepth.Orthographic = true
+
+	// nothing is drawn, but rendering must not fail
+	for _, camera := range []Camera{withoutFieldOfView, withoutDepth, orthographicWithoutDepth} {
+		renderer := NewSoftwareRenderer(16, 12)
+		renderer.SetClearColor(Color{1, 1, 1, 1})
+		renderer.SetCamera(camera)
+		renderer.BeginFrame()
+		world.Render(renderer)
+		renderer.EndFrame()
+
+		frame := renderer.Image()
+		for y := 0; y < frame.Bounds().Dy(); y++ {
+			for x := 0; x < frame.Bounds().Dx(); x++ {
+				if r, g, b, _ := frame.At(x, y).RGBA(); r != 0xffff || g != 0xffff || b != 0xffff {
+					t.Fatalf("Pixel %d, %d has been drawn with camera %v", x, y, camera)
+				}
+			}
+		}
+	}
+}
+
+func TestCamera(t *testing.T) {
+	defer func() {
+		scriptCamera.camera = DefaultCamera()
+	}()
+	graphicsQueue.Clear()
+
+	similar := func(a, b Vertex3D) bool {
+		return a.Sub(b).Length() < 1e-9
+	}
+
+	code := `(do
+		(camera-look-at [0 2 10] [0 2 0])
+		(camera-move [1 0 0])
+		(camera-turn 90 0)
+		(camera-perspective 60 1 50))`
+	if _, err := EvaluateString(code, MainContext); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// looking to the left after turning
+	camera := scriptCamera.camera
+	if !similar(camera.Position, Vertex3D{1, 2, 10}) || !similar(camera.Target, Vertex3D{-9, 2, 10}) {
+		t.Errorf("Unexpected camera position %v and target %v", camera.Position, camera.Target)
+	}
+	if camera.FieldOfView != 60 || camera.Near != 1 || camera.Far != 50 {
+		t.Errorf("Unexpected projection %v", camera)
+	}
+
+	// orbits the target from above and stops before passing over it
+	code = `(do
+		(camera-look-at [0 0 10] [0 0 0])
+		(camera-orbit 0 90)
+		(camera-orthographic))`
+	if _, err := EvaluateString(code, MainContext); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	camera = scriptCamera.camera
+	if camera.Position.Y < 9.99 || camera.Position.Z <= 0 || !camera.Orthographic {
+		t.Errorf("Unexpected camera %v", camera)
+	}
+
+	// invalid arguments leave the camera unchanged
+	invalid := []string{
+		`(camera-look-at [1 1 1] [0 0])`,
+		`(camera-look-at [1 1 1] [1 1 1])`,
+		`(camera-look-at [1 1 1] [0 0 0] [0 0 0])`,
+		`(camera-perspective 60 0.5)`,
+		`(camera-orthographic 1)`,
+		`(camera-perspective 0)`,
+		`(camera-perspective 180)`,
+		`(camera-perspective 60 0 50)`,
+		`(camera-perspective 60 -1 50)`,
+		`(camera-perspective 60 50 1)`,
+		`(camera-orthographic 10 10)`,
+		`(camera-orthographic 10 -10)`,
+	}
+	for _, expr := range invalid {
+		if _, err := EvaluateString(expr, MainContext); err == nil {
+			t.Errorf("%s has been accepted", expr)
+		}
+	}
+	if scriptCamera.camera != camera {
+		t.Errorf("Camera has been changed by a failed update")
+	}
+
+	result, _ := EvaluateString("(get (camera) :orthographic)", MainContext)
+	if result.String() != "true" {
+		t.Errorf("Expected orthographic camera, found %s", result.String())
+	}
+
+	// the renderer receives the camera through the graphics queue
+	renderer := NewSoftwareRenderer(4, 3)
+	graphicsQueue.Process(renderer)
+	if renderer.Camera() != camera {
+		t.Errorf("Expected renderer camera %v, found %v", camera, renderer.Camera())
+	}
+}
+
+// A camera looking along its up axis turns its up axis instead of rendering nothing
+func TestPNGBackendCamera(t *testing.T) {
+	defer func() {
+		scriptCamera.camera = DefaultCamera()
+	}()
+	defer graphicsQueue.Clear()
+
+	world := NewWorld()
+	world.Create(CreateCube(0, 0, 0))
+
+	backend := NewPNGBackend(filepath.Join(t.TempDir(), "frame-%d.png"), 40, 30)
+	if err := backend.Open(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the camera set by the update looks away from the cube, which the default camera shows
+	if _, err := EvaluateString("(camera-look-at [0 0 5] [0 0 10])", MainContext); err != nil {
+		t.Fatal(err.Error())
+	}
+	backend.Render(world, 0)
+
+	frame := backend.renderer.Image()
+	for y := 0; y < frame.Bounds().Dy(); y++ {
+		for x := 0; x < frame.Bounds().Dx(); x++ {
+			if r, g, b, _ := frame.At(x, y).RGBA(); r != 0xffff || g != 0xffff || b != 0xffff {
+				t.Fatalf("Pixel %d, %d has been drawn, the frame was rendered with the previous camera", x, y)
+			}
+		}
+	}
+}
+
+func TestCameraLookingDown(t *testing.T) {
+	defer func() {
+		scriptCamera.camera = DefaultCamera()
+	}()
+	defer graphicsQueue.Clear()
+
+	if _, err := EvaluateString("(camera-look-at [0 10 0] [0 0 0])", MainContext); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	camera := scriptCamera.camera
+	view := camera.ViewMatrix().Transform(camera.Target)
+	if math.Abs(view.X) > 1e-9 || math.Abs(view.Y) > 1e-9 || math.Abs(view.Z+10) > 1e-9 {
+		t.Errorf("Expected the target 10 units ahead, found %v", view)
+	}
+
+	renderer := NewSoftwareRenderer(40, 30)
+	renderer.SetClearColor(Color{1, 1, 1, 1})
+	renderer.SetCamera(camera)
+	renderer.BeginFrame()
+	renderer.DrawQuad(Quad{[4]Vertex3D{{-1, 0, -1}, {1, 0, -1}, {1, 0, 1}, {-1, 0, 1}}, Color{0, 0, 0, 1}})
+	renderer.EndFrame()
+
+	if r, _, _, _ := renderer.Image().At(20, 15).RGBA(); r != 0 {
+		t.Errorf("The floor below the camera has not been rendered")
+	}
+
+	// orbiting away from above keeps the distance to the target
+	if _, err := EvaluateString("(camera-orbit 30 -10)", MainContext); err != nil {
+		t.Fatal(err.Error())
+	}
+	if distance := scriptCamera.camera.Position.Length(); math.Abs(distance-10) > 1e-9 {
+		t.Errorf("Expected the camera 10 units from its target, found %v", distance)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import "container/list"
 import "fmt"
 import "bytes"
+import "sync"
+import "sync/atomic"
 import "mk/Apollo/events"
 
 type Data interface {
@@ -18,10 +20,18 @@ type DataType struct {
 type List struct {
 	*list.List
 	evaluated bool
+	pos       *SourcePos
 }
 
+// Vector is a sequence backed by a slice with constant time indexed access.
+// The literal [x1 x2 ...] evaluates to a vector.
+type Vector struct {
+	items *[]Data
+}
+
+// Dict maps keys to values, keys are compared by value (see Hasher)
 type Dict struct {
-	entries map[Data]Data
+	entries *hashTable
 }
 
 type String struct {
@@ -30,6 +40,7 @@ type String struct {
 
 type Symbol struct {
 	Value string
+	pos   *SourcePos
 }
 
 type Keyword struct {
@@ -97,22 +108,33 @@ func (l List) String() string {
 	return buffer.String()
 }
 
-func (d Dict) String() string {
+func (v Vector) String() string {
 	var buffer bytes.Buffer
-	buffer.WriteString("{")
-	i := 0
+	buffer.WriteString("[")
 
-	for key, value := range d.entries {
+	for i, item := range *v.items {
 		if i > 0 {
 			buffer.WriteString(" ")
 		}
+		buffer.WriteString(item.String())
+	}
+
+	buffer.WriteString("]")
+	return buffer.String()
+}
+
+func (d Dict) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteString("{")
+	d.Foreach(func(key Data, value Data) {
+		if buffer.Len() > 1 {
+			buffer.WriteString(" ")
+		}
 
 		buffer.WriteString(key.String())
 		buffer.WriteString(" ")
 		buffer.WriteString(value.String())
-
-		i++
-	}
+	})
 
 	buffer.WriteString("}")
 	return buffer.String()
@@ -142,18 +164,40 @@ func MakeList(args ...Data) List {
 
 func CreateDict() Dict {
 	return Dict{
-		entries: make(map[Data]Data),
+		entries: newHashTable(),
 	}
 }
 
+func (d Dict) Get(key Data) (Data, bool) {
+	return d.entries.get(key)
+}
+
 func (d Dict) GetOrDefault(key Data, defaultValue Data) Data {
-	if value, ok := d.entries[key]; ok {
+	if value, ok := d.entries.get(key); ok {
 		return value
 	} else {
 		return defaultValue
 	}
 }
 
+func (d Dict) Put(key Data, value Data) {
+	d.entries.put(key, value)
+}
+
+// Removes the entry for key, returns false if there is none
+func (d Dict) Remove(key Data) bool {
+	return d.entries.remove(key)
+}
+
+func (d Dict) Len() int {
+	return d.entries.count
+}
+
+// Calls f for each entry in the order of insertion
+func (d Dict) Foreach(f func(key Data, value Data)) {
+	d.entries.foreach(f)
+}
+
 func (ls List) Plus(a Data) Data {
 	switch t := a.(type) {
 	case List:
@@ -161,6 +205,13 @@ func (ls List) Plus(a Data) Data {
 		copy.PushBackList(ls.List)
 		copy.PushBackList(t.List)
 		return copy
+	case Vector:
+		copy := CreateList()
+		copy.PushBackList(ls.List)
+		for _, item := range t.Items() {
+			copy.PushBack(item)
+		}
+		return copy
 	default:
 		copy := CreateList()
 		copy.PushBackList(ls.List)
@@ -346,6 +397,124 @@ func (ls List) Map(f func(a Data, i int) Data) List {
 	return list
 }
 
+func CreateVector(capacity int) Vector {
+	items := make([]Data, 0, capacity)
+	return Vector{&items}
+}
+
+func MakeVector(items ...Data) Vector {
+	vector := CreateVector(len(items))
+	vector.Append(items...)
+	return vector
+}
+
+// Returns a new vector with the items of a list or vector, or a single item appended
+func (v Vector) Plus(a Data) Data {
+	copy := MakeVector(v.Items()...)
+
+	switch t := a.(type) {
+	case Vector:
+		copy.Append(t.Items()...)
+	case List:
+		t.Foreach(func(item Data, i int) {
+			copy.Append(item)
+		})
+	default:
+		copy.Append(t)
+	}
+
+	return copy
+}
+
+func (v Vector) Len() int {
+	return len(*v.items)
+}
+
+// Returns the items of the vector, which must not be modified
+func (v Vector) Items() []Data {
+	return *v.items
+}
+
+// resolves negative indices as offset from back, returns -1 if out of range
+func (v Vector) index(n int) int {
+	if n < 0 {
+		n += v.Len()
+	}
+	if n < 0 || n >= v.Len() {
+		return -1
+	}
+	return n
+}
+
+func (v Vector) Get(n int) Data {
+	if i := v.index(n); i >= 0 {
+		return (*v.items)[i]
+	}
+
+	return Nothing{}
+}
+
+func (v Vector) Set(n int, value Data) Data {
+	if i := v.index(n); i >= 0 {
+		(*v.items)[i] = value
+		return value
+	}
+
+	return Nothing{}
+}
+
+func (v Vector) Append(values ...Data) {
+	*v.items = append(*v.items, values...)
+}
+
+func (v Vector) Prepend(values ...Data) {
+	*v.items = append(append(make([]Data, 0, len(values)+v.Len()), values...), *v.items...)
+}
+
+// Returns a new vector containing the items between startIncl and endExcl
+func (v Vector) Slice(startIncl int, endExcl int) Vector {
+	if startIncl < 0 {
+		startIncl += v.Len()
+	}
+	if endExcl < 0 {
+		endExcl += v.Len()
+	}
+	if endExcl > v.Len() {
+		endExcl = v.Len()
+	}
+	if startIncl < 0 || startIncl >= endExcl {
+		return CreateVector(0)
+	}
+
+	return MakeVector((*v.items)[startIncl:endExcl]...)
+}
+
+func (v Vector) Foreach(f func(a Data, i int)) {
+	for i, item := range *v.items {
+		f(item, i)
+	}
+}
+
+func (v Vector) Filter(f func(a Data, i int) bool) Vector {
+	vector := CreateVector(0)
+	for i, item := range *v.items {
+		if f(item, i) {
+			vector.Append(item)
+		}
+	}
+
+	return vector
+}
+
+func (v Vector) Map(f func(a Data, i int) Data) Vector {
+	vector := CreateVector(v.Len())
+	for i, item := range *v.items {
+		vector.Append(f(item, i))
+	}
+
+	return vector
+}
+
 func (x NativeObject) GetType() DataType {
 	return NativeObjectType
 }
@@ -378,6 +547,10 @@ func (x List) GetType() DataType {
 	return ListType
 }
 
+func (x Vector) GetType() DataType {
+	return VectorType
+}
+
 func (x Dict) GetType() DataType {
 	return DictType
 }
@@ -475,6 +648,48 @@ func (x List) Equals(other Data) bool {
 			a = a.Next()
 			b = b.Next()
 		}
+
+		return true
+	case Vector:
+		return t.Equals(x)
+	case PersistentVector:
+		return t.Equals(x)
+	}
+
+	return false
+}
+
+// vectors are equal to vectors and lists with equal contents
+func (x Vector) Equals(other Data) bool {
+	switch t := other.(type) {
+	case Vector:
+		if t.Len() != x.Len() {
+			return false
+		}
+
+		for i, item := range *x.items {
+			if !item.Equals((*t.items)[i]) {
+				return false
+			}
+		}
+
+		return true
+	case List:
+		if t.Len() != x.Len() {
+			return false
+		}
+
+		i := 0
+		for e := t.Front(); e != nil; e = e.Next() {
+			if !(*x.items)[i].Equals(e.Value.(Data)) {
+				return false
+			}
+			i++
+		}
+
+		return true
+	case PersistentVector:
+		return t.Equals(x)
 	}
 
 	return false
@@ -513,22 +728,22 @@ func (x DataType) Equals(other Data) bool {
 }
 
 func (x Dict) Equals(other Data) bool {
+	if persistent, ok := other.(PersistentMap); ok {
+		return persistent.Equals(x)
+	}
+
 	otherDict, ok := other.(Dict)
-	if !ok {
+	if !ok || otherDict.Len() != x.Len() {
 		return false
 	}
 
-	for key, value := range x.entries {
-		otherValue, ok := otherDict.entries[key]
-		if !ok {
-			return false
-		}
-		if !otherValue.Equals(value) {
-			return false
-		}
-	}
+	equal := true
+	x.Foreach(func(key Data, value Data) {
+		otherValue, ok := otherDict.Get(key)
+		equal = equal && ok && otherValue.Equals(value)
+	})
 
-	return true
+	return equal
 }
 
 func (x NativeFunction) Equals(other Data) bool {
@@ -570,6 +785,82 @@ func (def *UserEventDefinition) GetType() DataType {
 	return EventType
 }
 
+// Returns the names of the event parameters as keywords, e.g. :dir for (defevent Move :dir)
+func (def *UserEventDefinition) Parameters() []Keyword {
+	params := make([]Keyword, 0, def.Arguments.Len())
+	def.Arguments.Foreach(func(arg Data, i int) {
+		switch t := arg.(type) {
+		case Keyword:
+			params = append(params, t)
+		case Symbol:
+			params = append(params, Keyword{":" + t.Value})
+		default:
+			panic(fmt.Sprintf("Invalid parameter %s for event %s", arg.String(), def.Name))
+		}
+	})
+	return params
+}
+
+func (def *UserEventDefinition) hasParameter(name Keyword) bool {
+	for _, param := range def.Parameters() {
+		if param.Equals(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Assigns the arguments of a trigger call to the event parameters. Arguments are either given
+// by position (value1 value2 ...) or by name (:key1 value1 :key2 value2 ...).
+func (def *UserEventDefinition) BindArguments(args List) Dict {
+	params := def.Parameters()
+	values := CreateDict()
+
+	if def.isKeywordArguments(args) {
+		for i := 0; i < args.Len(); i += 2 {
+			key := args.Get(i).(Keyword)
+			if !def.hasParameter(key) {
+				panic(fmt.Sprintf("Unknown parameter %s for event %s", key.Value, def.Name))
+			}
+			if _, ok := values.Get(key); ok {
+				panic(fmt.Sprintf("Parameter %s for event %s is assigned twice", key.Value, def.Name))
+			}
+			values.Put(key, args.Get(i+1))
+		}
+	} else {
+		if args.Len() > len(params) {
+			panic(fmt.Sprintf("Too many arguments for event %s: expected %d, got %d", def.Name,
+				len(params), args.Len()))
+		}
+		args.Foreach(func(arg Data, i int) {
+			values.Put(params[i], arg)
+		})
+	}
+
+	for _, param := range params {
+		if _, ok := values.Get(param); !ok {
+			panic(fmt.Sprintf("Missing argument %s for event %s", param.Value, def.Name))
+		}
+	}
+
+	return values
+}
+
+// arguments are given by name if they come in pairs starting with a keyword that either
+// names a parameter or can't be a positional argument
+func (def *UserEventDefinition) isKeywordArguments(args List) bool {
+	if args.Len() == 0 || args.Len()%2 != 0 {
+		return false
+	}
+
+	key, ok := args.First().(Keyword)
+	if !ok {
+		return false
+	}
+
+	return def.hasParameter(key) || args.Len() > len(def.Parameters())
+}
+
 //---
 
 type UserEvent struct {
@@ -585,47 +876,276 @@ type UserEventHandler struct {
 	Owner   *Entity
 	Handler *Function
 
-	eventChannel events.EventChannel
-	closure      *Context
+	// name or pattern of the subscribed events and, if given, the only entity whose events are handled
+	Event  string
+	Source *Entity
+
+	// if given, the only property whose PropertyChanged events are handled, see on-change
+	Property string
+
+	// handlers with higher priority are called first
+	Priority int
+
+	bus *events.EventBus
+
+	// set once the handler has been unsubscribed, accessed atomically
+	stopped int32
 }
 
-func NewUserEventHandler(owner *Entity, handlerFunction *Function, context *Context) *UserEventHandler {
+func NewUserEventHandler(owner *Entity, handlerFunction *Function) *UserEventHandler {
 	handler := new(UserEventHandler)
 	handler.Owner = owner
 	handler.Handler = handlerFunction
-	handler.eventChannel = make(events.EventChannel, 100)
-	handler.closure = context
-
-	go handler.handleEvents()
 
 	return handler
 }
 
+func (handler *UserEventHandler) String() string {
+	return "Subscription<" + handler.Event + ">"
+}
+
+func (handler *UserEventHandler) Equals(other Data) bool {
+	return handler == other
+}
+
+func (handler *UserEventHandler) GetType() DataType {
+	return SubscriptionType
+}
+
+// Handlers are called by the event bus directly, so they don't need a channel
 func (handler *UserEventHandler) EventChannel() events.EventChannel {
-	return handler.eventChannel
+	return nil
 }
 
 func (handler *UserEventHandler) EventSourceID() uint64 {
 	return handler.Owner.id
 }
 
-func (handler *UserEventHandler) handleEvents() {
-	for event := range handler.eventChannel {
-		if event == nil {
-			close(handler.eventChannel)
-			return
+// Calls the handler function. Returns true if the handler consumed the event by returning
+// the result of (consume-event).
+func (handler *UserEventHandler) HandleEvent(event events.Event) bool {
+	// events that were already on their way when unsubscribing are dropped
+	if atomic.LoadInt32(&handler.stopped) != 0 {
+		return false
+	}
+
+	switch t := event.(type) {
+	case *UserEvent:
+		return handler.handleUserEvent(t)
+	case events.EventMessage:
+		return handler.handleUserEvent(t.Content.(*UserEvent))
+	}
+
+	return false
+}
+
+func (handler *UserEventHandler) handleUserEvent(event *UserEvent) bool {
+	consumed := handler.handles(event) && handler.call(event)
+
+	// subscriptions to the events of an entity end with its destruction, see Entity.Destroy
+	if handler.Source != nil && event.Definition == DestroyedEvent {
+		handler.Unsubscribe()
+	}
+
+	return consumed
+}
+
+func (handler *UserEventHandler) handles(event *UserEvent) bool {
+	if handler.Property == "" {
+		return true
+	}
+
+	property, ok := event.Arguments.Get(Keyword{":property"})
+	return ok && property.Equals(Keyword{handler.Property})
+}
+
+// calls the handler function, a failing call is reported but doesn't stop the handler
+func (handler *UserEventHandler) call(event *UserEvent) (consumed bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			fmt.Printf("Handler %s failed for %s: %s\n", handler.Handler.Name, event.EventName(),
+				NewRuntimeError(e, nil).Error())
+			consumed = false
+		}
+	}()
+
+	result := handler.Handler.Apply(handler.arguments(event))
+	return EventConsumed.Equals(result)
+}
+
+// Handlers receive the owner and a dict of the event arguments, e.g. (fn [entity args] ...).
+// Handlers naming the event parameters receive the arguments one by one instead,
+// e.g. (fn [entity dir] ...) for (defevent Move :dir). Handlers subscribed to a pattern
+// receive the event as well, e.g. (fn [entity event args] ...). Handlers of property changes
+// receive the new and the old value, e.g. (fn [entity new old] ...).
+func (handler *UserEventHandler) arguments(event *UserEvent) List {
+	if handler.Property != "" {
+		value, _ := event.Arguments.Get(Keyword{":new"})
+		old, _ := event.Arguments.Get(Keyword{":old"})
+		if takesOldValue(handler.Handler) {
+			return MakeList(handler.Owner, value, old)
+		}
+		return MakeList(handler.Owner, value)
+	}
+
+	if events.IsPattern(handler.Event) {
+		return MakeList(handler.Owner, event.Definition, event.Arguments)
+	}
+
+	params := event.Definition.Parameters()
+
+	for _, dispatcher := range handler.Handler.Dispatchers {
+		if destructures(dispatcher, params) {
+			args := MakeList(handler.Owner)
+			for _, param := range params {
+				value, _ := event.Arguments.Get(param)
+				args.PushBack(value)
+			}
+			return args
+		}
+	}
+
+	return MakeList(handler.Owner, event.Arguments)
+}
+
+// property change handlers may leave out the old value, e.g. (fn [entity health] ...)
+func takesOldValue(handler *Function) bool {
+	for _, dispatcher := range handler.Dispatchers {
+		switch len(dispatcher.Parameters) {
+		case 2:
+			return false
+		case 3:
+			return true
+		}
+	}
+
+	return true
+}
+
+// checks if the parameters following the owner are named like the event parameters
+func destructures(dispatcher DispatchPattern, params []Keyword) bool {
+	if len(dispatcher.Parameters) != len(params)+1 {
+		return false
+	}
+
+	for i, param := range params {
+		if ":"+dispatcher.Parameters[i+1].ParameterName() != param.Value {
+			return false
+		}
+	}
+
+	return true
+}
+
+//---
+
+// handlers by the ID of their owning entity, and by the ID of the entity they are restricted to
+var userEventHandlers = struct {
+	sync.Mutex
+	byOwner  map[uint64][]*UserEventHandler
+	bySource map[uint64][]*UserEventHandler
+}{byOwner: make(map[uint64][]*UserEventHandler), bySource: make(map[uint64][]*UserEventHandler)}
+
+// Subscribes the owner to events of the given type, optionally to those triggered by source only.
+// The returned handler identifies the subscription.
+func SubscribeUserEvent(bus *events.EventBus, owner *Entity, event string, source *Entity,
+	handlerFunction *Function, priority int) *UserEventHandler {
+	handler := NewUserEventHandler(owner, handlerFunction)
+	return subscribeUserEventHandler(bus, handler, event, source, priority)
+}
+
+// Subscribes the owner to the changes of one of its properties, see PropertyChangedEvent
+func SubscribePropertyChange(bus *events.EventBus, owner *Entity, property Keyword,
+	handlerFunction *Function, priority int) *UserEventHandler {
+	handler := NewUserEventHandler(owner, handlerFunction)
+	handler.Property = property.Value
+	return subscribeUserEventHandler(bus, handler, PropertyChangedEvent.Name, owner, priority)
+}
+
+func subscribeUserEventHandler(bus *events.EventBus, handler *UserEventHandler, event string, source *Entity,
+	priority int) *UserEventHandler {
+	handler.Event = event
+	handler.Source = source
+	handler.Priority = priority
+	handler.bus = bus
+
+	userEventHandlers.Lock()
+	userEventHandlers.byOwner[handler.Owner.id] = append(userEventHandlers.byOwner[handler.Owner.id], handler)
+	if source != nil {
+		userEventHandlers.bySource[source.id] = append(userEventHandlers.bySource[source.id], handler)
+	}
+	userEventHandlers.Unlock()
+
+	bus.Subscribe(handler, event, handler.source(), priority)
+
+	return handler
+}
+
+// Returns the handlers of the owner for the event name or pattern (or any event if empty) that
+// are restricted to the given source and run the given function (or any if nil).
+func FindUserEventHandlers(owner *Entity, event string, source *Entity, handlerFunction *Function) []*UserEventHandler {
+	userEventHandlers.Lock()
+	defer userEventHandlers.Unlock()
+
+	found := make([]*UserEventHandler, 0)
+	for _, handler := range userEventHandlers.byOwner[owner.id] {
+		if event != "" && (handler.Event != event || handler.Source != source) {
+			continue
+		}
+		if handlerFunction != nil && handler.Handler != handlerFunction {
+			continue
 		}
+		found = append(found, handler)
+	}
 
-		switch t := event.(type) {
-		case *UserEvent:
-			args := MakeList(handler.Owner, t.Arguments)
-			handler.Handler.Call(args, handler.closure)
-		case events.EventMessage:
-			e := t.Content.(*UserEvent)
-			args := MakeList(handler.Owner, e.Arguments)
-			handler.Handler.Call(args, handler.closure)
+	return found
+}
+
+// Returns the handlers of any owner that are restricted to events triggered by the source
+func FindSourceEventHandlers(source *Entity) []*UserEventHandler {
+	userEventHandlers.Lock()
+	defer userEventHandlers.Unlock()
+
+	return append([]*UserEventHandler(nil), userEventHandlers.bySource[source.id]...)
+}
+
+// Stops the delivery of events to the handler and shuts it down
+func (handler *UserEventHandler) Unsubscribe() {
+	if !atomic.CompareAndSwapInt32(&handler.stopped, 0, 1) {
+		return
+	}
+
+	userEventHandlers.Lock()
+	removeUserEventHandler(userEventHandlers.byOwner, handler.Owner.id, handler)
+	if handler.Source != nil {
+		removeUserEventHandler(userEventHandlers.bySource, handler.Source.id, handler)
+	}
+	userEventHandlers.Unlock()
+
+	handler.bus.Unsubscribe(handler, handler.Event, handler.source())
+}
+
+func removeUserEventHandler(handlersByID map[uint64][]*UserEventHandler, id uint64, handler *UserEventHandler) {
+	handlers := handlersByID[id]
+	for i, h := range handlers {
+		if h == handler {
+			handlers = append(handlers[:i:i], handlers[i+1:]...)
+			break
 		}
 	}
+	if len(handlers) == 0 {
+		delete(handlersByID, id)
+	} else {
+		handlersByID[id] = handlers
+	}
+}
+
+// the source as seen by the event bus, which expects nil for events of any source
+func (handler *UserEventHandler) source() events.EventSource {
+	if handler.Source == nil {
+		return nil
+	}
+	return handler.Source
 }
 
 //=============================================================================
@@ -639,6 +1159,10 @@ var FloatType = DataType{"Float"}
 var IntType = DataType{"Int"}
 var KeywordType = DataType{"Keyword"}
 var ListType = DataType{"List"}
+var VectorType = DataType{"Vector"}
+var PersistentVectorType = DataType{"PersistentVector"}
+var PersistentMapType = DataType{"PersistentMap"}
+var PersistentSetType = DataType{"PersistentSet"}
 var FunctionType = DataType{"Function"}
 var NativeFunctionBType = DataType{"NativeFunctionB"}
 var NativeFunctionType = DataType{"NativeFunction"}
@@ -650,3 +1174,12 @@ var ContextType = DataType{"Context"}
 var EntityType = DataType{"Entity"}
 var NativeObjectType = DataType{"NativeObject"}
 var EventType = DataType{"Event"}
+var SubscriptionType = DataType{"Subscription"}
+var SystemType = DataType{"System"}
+var TraitType = DataType{"Trait"}
+
+// returned by event handlers to stop the propagation of the event to other handlers
+var EventConsumed = Keyword{":event-consumed"}
+var ErrorType = DataType{"Error"}
+var TailExpressionType = DataType{"TailExpression"}
+var MacroType = DataType{"Macro"}
@@ -1,13 +1,28 @@
 package main
 
 import "fmt"
+import "sync"
 import "mk/Apollo/events"
 
 /* Entity Component System */
 
+// The ID of an entity consists of an index (lower 32 bits) and a generation (upper 32 bits).
+// Indices of destroyed entities are reused with the next generation, so references to a
+// destroyed entity never match the entity reusing its index.
 type Entity struct {
-	id   uint64
-	data map[string]Data
+	id uint64
+}
+
+func entityID(index uint32, generation uint32) uint64 {
+	return uint64(generation)<<32 | uint64(index)
+}
+
+func (e *Entity) index() uint32 {
+	return uint32(e.id)
+}
+
+func (e *Entity) generation() uint32 {
+	return uint32(e.id >> 32)
 }
 
 func (e *Entity) String() string {
@@ -26,20 +41,224 @@ func (e *Entity) Equals(other Data) bool {
 	return false
 }
 
-func (e *Entity) Set(property string, value Data) {
-	if old, ok := e.data[property]; ok {
-		e.data[property] = value
-		// do sth with old
-		fmt.Printf(old.String())
-	} else {
-		e.data[property] = value
+// Adds the component to the entity or replaces its value. Returns the previous value or nil.
+func (e *Entity) Set(component Keyword, value Data) Data {
+	if !e.Alive() {
+		panic(fmt.Sprintf("%s has been destroyed", e.String()))
+	}
+	return entityComponents.set(e, component, value)
+}
+
+// Returns the value of the component if the entity has it
+func (e *Entity) Get(component Keyword) (Data, bool) {
+	return entityComponents.get(e, component)
+}
+
+// Removes the component from the entity, returns false if it didn't have it
+func (e *Entity) Remove(component Keyword) bool {
+	return entityComponents.remove(e, component)
+}
+
+// Sets the component like Set and triggers PropertyChanged with the entity as source if
+// its value has changed
+func (e *Entity) SetProperty(component Keyword, value Data, bus events.EventTransmitter) {
+	old := e.Set(component, value)
+	if old == nil {
+		old = Nothing{}
+	}
+
+	if !old.Equals(value) {
+		triggerPropertyChanged(e, component, old, value, bus)
+	}
+}
+
+// Removes the component like Remove and triggers PropertyChanged with Nothing as new value
+// if the entity had it
+func (e *Entity) RemoveProperty(component Keyword, bus events.EventTransmitter) {
+	old, ok := e.Get(component)
+	if ok && e.Remove(component) {
+		triggerPropertyChanged(e, component, old, Nothing{}, bus)
+	}
+}
+
+func triggerPropertyChanged(e *Entity, component Keyword, old Data, value Data, bus events.EventTransmitter) {
+	args := PropertyChangedEvent.BindArguments(MakeList(component, old, value))
+	bus.Trigger(&UserEvent{PropertyChangedEvent, args}, e)
+}
+
+//-----------------------------------------------------------------------------
+// Component storage
+
+// Sparse set holding the values of one component type. The values are stored densely
+// for fast iteration and indexed by entity ID for fast lookup.
+type componentSet struct {
+	entities []*Entity
+	values   []Data
+
+	// position+1 of the entity in the dense arrays by entity ID, 0 if it doesn't have the component
+	sparse []int
+}
+
+// returns the position of the entity in the dense arrays or -1. Entities of an older
+// generation aren't found.
+func (set *componentSet) index(e *Entity) int {
+	index := e.index()
+	if index >= uint32(len(set.sparse)) {
+		return -1
+	}
+
+	i := set.sparse[index] - 1
+	if i < 0 || set.entities[i].id != e.id {
+		return -1
+	}
+	return i
+}
+
+// sets the value of the entity, returns the previous one or nil
+func (set *componentSet) set(e *Entity, value Data) Data {
+	if i := set.index(e); i >= 0 {
+		old := set.values[i]
+		set.values[i] = value
+		return old
+	}
+
+	index := e.index()
+	if index >= uint32(len(set.sparse)) {
+		sparse := make([]int, index+1, 2*index+1)
+		copy(sparse, set.sparse)
+		set.sparse = sparse
+	}
+
+	if set.sparse[index] != 0 {
+		panic(fmt.Sprintf("%s has been destroyed", e.String()))
+	}
+
+	set.entities = append(set.entities, e)
+	set.values = append(set.values, value)
+	set.sparse[index] = len(set.entities)
+	return nil
+}
+
+func (set *componentSet) remove(e *Entity) bool {
+	i := set.index(e)
+	if i < 0 {
+		return false
+	}
+
+	// moves the last entry into the gap
+	last := len(set.entities) - 1
+	set.entities[i] = set.entities[last]
+	set.values[i] = set.values[last]
+	set.sparse[set.entities[i].index()] = i + 1
+	set.sparse[e.index()] = 0
+
+	set.entities[last] = nil
+	set.values[last] = nil
+	set.entities = set.entities[:last]
+	set.values = set.values[:last]
+	return true
+}
+
+type componentStorage struct {
+	sets  map[string]*componentSet
+	mutex sync.RWMutex
+}
+
+var entityComponents = componentStorage{sets: make(map[string]*componentSet)}
+
+func (s *componentStorage) set(e *Entity, component Keyword, value Data) Data {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	set, ok := s.sets[component.Value]
+	if !ok {
+		set = new(componentSet)
+		s.sets[component.Value] = set
+	}
+	return set.set(e, value)
+}
+
+func (s *componentStorage) get(e *Entity, component Keyword) (Data, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if set, ok := s.sets[component.Value]; ok {
+		if i := set.index(e); i >= 0 {
+			return set.values[i], true
+		}
+	}
+	return nil, false
+}
+
+func (s *componentStorage) remove(e *Entity, component Keyword) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if set, ok := s.sets[component.Value]; ok {
+		return set.remove(e)
+	}
+	return false
+}
+
+// removes all components of the entity
+func (s *componentStorage) removeAll(e *Entity) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, set := range s.sets {
+		set.remove(e)
 	}
 }
 
+// Returns the entities having all of the given components. The smallest component
+// set is iterated and the others are only checked for each of its entities.
+func (s *componentStorage) query(components []Keyword) []*Entity {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	sets := make([]*componentSet, len(components))
+	smallest := 0
+	for i, component := range components {
+		set, ok := s.sets[component.Value]
+		if !ok {
+			return nil
+		}
+		sets[i] = set
+		if len(set.entities) < len(sets[smallest].entities) {
+			smallest = i
+		}
+	}
+
+	found := make([]*Entity, 0, len(sets[smallest].entities))
+	for _, e := range sets[smallest].entities {
+		matches := true
+		for _, set := range sets {
+			if set.index(e) < 0 {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			found = append(found, e)
+		}
+	}
+
+	return found
+}
+
+//-----------------------------------------------------------------------------
+// Entity IDs
+
 var shutdown = false
 var newEntities = make(chan *Entity)
 var ids = make(chan uint64)
 
+// current generation of each entity index, an entity is alive while its generation matches
+var entityGenerations = struct {
+	sync.RWMutex
+	generations []uint32
+}{generations: make([]uint32, 1)}
+
 func ECS_init() {
 	go generate_entity_ids(newEntities, ids)
 }
@@ -56,6 +275,54 @@ func NewEntity() *Entity {
 	return ent
 }
 
+// Returns false once the entity has been destroyed
+func (e *Entity) Alive() bool {
+	entityGenerations.RLock()
+	defer entityGenerations.RUnlock()
+
+	index := e.index()
+	return index > 0 && index < uint32(len(entityGenerations.generations)) &&
+		entityGenerations.generations[index] == e.generation()
+}
+
+// Destroys the entity: its components are removed and its event handlers are unsubscribed.
+// Returns false if the entity had already been destroyed.
+func (e *Entity) Destroy() bool {
+	entityGenerations.Lock()
+	index := e.index()
+	if index == 0 || index >= uint32(len(entityGenerations.generations)) ||
+		entityGenerations.generations[index] != e.generation() {
+		entityGenerations.Unlock()
+		return false
+	}
+	entityGenerations.generations[index]++
+	entityGenerations.Unlock()
+
+	entityComponents.removeAll(e)
+	leaveTraits(e)
+
+	// subscriptions to the Destroyed event of the entity, its own included, end once they have
+	// received it, all others are cancelled right away
+	for _, handler := range FindUserEventHandlers(e, "", nil, nil) {
+		own := handler.Source != nil && handler.Source.id == e.id
+		if !own || !events.MatchEventName(handler.Event, DestroyedEvent.Name) {
+			handler.Unsubscribe()
+		}
+	}
+	for _, handler := range FindSourceEventHandlers(e) {
+		if !events.MatchEventName(handler.Event, DestroyedEvent.Name) {
+			handler.Unsubscribe()
+		}
+	}
+
+	// the index is free to be reused
+	if !shutdown {
+		newEntities <- e
+	}
+
+	return true
+}
+
 func (e *Entity) EventChannel() events.EventChannel {
 	// TODO: define global event channel for entity
 	return nil
@@ -65,13 +332,35 @@ func (e *Entity) EventSourceID() uint64 {
 	return e.id
 }
 
+// Hands out the IDs of new entities (sent with ID 0) and takes back the indices of
+// destroyed ones, which are reused in the order they have been freed
 func generate_entity_ids(entities chan *Entity, ids chan uint64) {
-	i := uint64(1)
+	next := uint32(1)
+	free := make([]uint32, 0)
+
 	for e := range entities {
-		if e.id == 0 {
-			ids <- i
+		if e.id != 0 {
+			free = append(free, e.index())
+			continue
+		}
+
+		var index uint32
+		if len(free) > 0 {
+			index = free[0]
+			free = free[1:]
+		} else {
+			index = next
+			next++
 		}
-		i++
+
+		entityGenerations.Lock()
+		if index >= uint32(len(entityGenerations.generations)) {
+			entityGenerations.generations = append(entityGenerations.generations, 0)
+		}
+		generation := entityGenerations.generations[index]
+		entityGenerations.Unlock()
+
+		ids <- entityID(index, generation)
 	}
 	close(ids)
 }
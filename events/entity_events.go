@@ -1,4 +0,0 @@
-package events
-
-type PropertyChanged struct {
-}
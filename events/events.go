@@ -1,6 +1,7 @@
 package events
 
-import "strconv"
+import "strings"
+import "sync"
 
 type Event interface {
 	EventName() string
@@ -25,16 +26,66 @@ type EventSource interface {
 
 type EventChannel chan Event
 
+// Event sources that process events themselves rather than receiving them through their
+// channel. They are called in order of priority and can stop the propagation of an event.
+type EventHandler interface {
+	EventSource
+
+	// Handles the event and returns true if it has been consumed, i.e. shall not be
+	// passed on to the remaining subscribers
+	HandleEvent(event Event) bool
+}
+
 type Subscription struct {
 	Subscriber EventSource
-	EventType  string
-	Source     EventSource
+
+	// name of the events, or a pattern matching several events, see MatchEventName
+	EventType string
+	Source    EventSource
+
+	// subscribers with higher priority receive events first
+	Priority int
 }
 
 func (s Subscription) EventName() string {
 	return "Subscription<" + s.EventType + ">"
 }
 
+// Two subscriptions are the same if they are by the same subscriber for the same events,
+// regardless of their priority
+func (s Subscription) sameAs(other Subscription) bool {
+	return s.Subscriber == other.Subscriber && s.EventType == other.EventType && s.Source == other.Source
+}
+
+// checks if the subscription is for the type and (if given) the source of the event
+func (s Subscription) matches(event EventMessage) bool {
+	if !MatchEventName(s.EventType, event.Content.EventName()) {
+		return false
+	}
+
+	return s.Source == nil || (event.Source != nil && s.Source.EventSourceID() == event.Source.EventSourceID())
+}
+
+// Event names can be namespaced, e.g. Input/KeyDown. Patterns ending in /* match all events
+// within the namespace and its nested namespaces, e.g. Input/* matches Input/KeyDown and
+// Input/Mouse/Move. The pattern * matches all events.
+func MatchEventName(pattern string, name string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(name, pattern[:len(pattern)-1])
+	}
+
+	return pattern == name
+}
+
+// Checks if the subscribed event type is a pattern rather than the name of an event
+func IsPattern(eventType string) bool {
+	return eventType == "*" || strings.HasSuffix(eventType, "/*")
+}
+
 type Cancellation struct {
 	Subscription
 }
@@ -43,45 +94,98 @@ func (s Cancellation) EventName() string {
 	return "Cancellation<" + s.EventType + ">"
 }
 
+// Queue for all events of one type. Besides the subscribers of the type itself it contains
+// the subscribers of all patterns matching the type.
 type EventQueue struct {
-	Relay       EventChannel
-	Subscribers map[Subscription]EventSource
+	Relay EventChannel
+
+	// ordered by descending priority and, for equal priorities, by time of subscription
+	Subscribers []Subscription
 }
 
+// Creates a queue that relays events sent to its Relay channel on its own goroutine
 func NewEventQueue() *EventQueue {
-	q := new(EventQueue)
-	q.Relay = make(EventChannel)
-	q.Subscribers = make(map[Subscription]EventSource, 1)
+	q := newQueue()
+	q.Relay = make(EventChannel, 1000)
 	go q.relayEvents()
 	return q
 }
 
+// creates a queue without relay channel, which is processed by the caller
+func newQueue() *EventQueue {
+	q := new(EventQueue)
+	q.Subscribers = make([]Subscription, 0, 1)
+	return q
+}
+
 func (queue *EventQueue) relayEvents() {
 	for event := range queue.Relay {
-		// relay events
-		switch t := event.(type) {
-		case Subscription:
-			// adds a new subscriber to this queue
-			queue.Subscribers[t] = t.Subscriber
-		case Cancellation:
-			// removes a subscriber from this queue
-			delete(queue.Subscribers, t.Subscription)
-		default:
-			// relays this event to all subscribers
-			for _, subscriber := range queue.Subscribers {
-				subscriber.EventChannel() <- event
-			}
+		queue.process(event)
+	}
+}
+
+func (queue *EventQueue) process(event Event) {
+	switch t := event.(type) {
+	case Subscription:
+		// adds a new subscriber to this queue
+		queue.add(t)
+	case Cancellation:
+		// removes a subscriber from this queue
+		queue.remove(t.Subscription)
+	case EventMessage:
+		// relays this event to the subscribers
+		propagate(queue.Subscribers, t)
+	}
+}
+
+func (queue *EventQueue) add(subscription Subscription) {
+	queue.remove(subscription)
+
+	// insert behind all subscribers with the same or higher priority
+	i := len(queue.Subscribers)
+	for i > 0 && queue.Subscribers[i-1].Priority < subscription.Priority {
+		i--
+	}
+
+	queue.Subscribers = append(queue.Subscribers, Subscription{})
+	copy(queue.Subscribers[i+1:], queue.Subscribers[i:])
+	queue.Subscribers[i] = subscription
+}
+
+func (queue *EventQueue) remove(subscription Subscription) {
+	for i, s := range queue.Subscribers {
+		if s.sameAs(subscription) {
+			queue.Subscribers = append(queue.Subscribers[:i:i], queue.Subscribers[i+1:]...)
+			return
 		}
 	}
 }
 
-// QueueName returns a canonical name for the channel that should be used
-// for events of the given type and for the specified event source.
-func QueueName(event string, src EventSource) string {
-	if src != nil {
-		return event + "@" + strconv.FormatUint(src.EventSourceID(), 32)
+// passes a subscription, cancellation or event on to the queue's goroutine, or
+// processes it right away if the queue has no goroutine
+func (queue *EventQueue) send(event Event) {
+	if queue.Relay != nil {
+		queue.Relay <- event
 	} else {
-		return event
+		queue.process(event)
+	}
+}
+
+// Delivers the event to the matching subscribers in order until one of them consumes it.
+// Subscribers that are no EventHandler receive the event through their channel.
+func propagate(subscribers []Subscription, event EventMessage) {
+	for _, subscription := range subscribers {
+		if !subscription.matches(event) {
+			continue
+		}
+
+		if handler, ok := subscription.Subscriber.(EventHandler); ok {
+			if handler.HandleEvent(event) {
+				return
+			}
+		} else {
+			subscription.Subscriber.EventChannel() <- event
+		}
 	}
 }
 
@@ -90,19 +194,38 @@ func QueueName(event string, src EventSource) string {
 
 type EventTransmitter interface {
 	// Subscribes to events of given type and optionally (source > 0) to events
-	// triggered by a specific other entity only
-	Subscribe(subscriber EventSource, event string, source EventSource)
+	// triggered by a specific other entity only. Subscribers with higher priority
+	// receive events first and may consume them.
+	Subscribe(subscriber EventSource, event string, source EventSource, priority int)
 	Unsubscribe(subscriber EventSource, event string, source EventSource)
 
 	// Triggers an event providing the ID of the originating entity
 	Trigger(event Event, source EventSource)
 }
 
+// Receives every event passing through the event bus before it is delivered
+type EventRecorder interface {
+	Record(event EventMessage)
+}
+
 type EventBus struct {
 	subscribeRequests   chan Subscription
 	unsubscribeRequests chan Cancellation
 	eventRequests       chan EventMessage
 	queues              map[string]*EventQueue
+
+	// subscriptions to patterns of event names, which are added to all matching queues
+	patterns []Subscription
+
+	// synchronous mode: events are queued until Dispatch is called
+	synchronous bool
+	mutex       sync.Mutex
+	pending     []EventMessage
+
+	recorder EventRecorder
+
+	// while replaying, only injected events are delivered
+	replaying bool
 }
 
 func (bus *EventBus) Init() {
@@ -110,11 +233,33 @@ func (bus *EventBus) Init() {
 	bus.unsubscribeRequests = make(chan Cancellation)
 	bus.eventRequests = make(chan EventMessage, 1000)
 	bus.queues = make(map[string]*EventQueue, 100)
+	bus.patterns = make([]Subscription, 0)
 
 	go bus.Run()
 }
 
+// Initializes the bus in synchronous mode. Triggered events are queued and delivered by
+// Dispatch in the order they have been triggered, on the goroutine calling Dispatch.
+func (bus *EventBus) InitSynchronous() {
+	bus.synchronous = true
+	bus.queues = make(map[string]*EventQueue, 100)
+	bus.patterns = make([]Subscription, 0)
+	bus.pending = make([]EventMessage, 0, 100)
+}
+
+func (bus *EventBus) Synchronous() bool {
+	return bus.synchronous
+}
+
 func (bus *EventBus) Shutdown() {
+	if bus.synchronous {
+		bus.mutex.Lock()
+		bus.queues = nil
+		bus.pending = nil
+		bus.mutex.Unlock()
+		return
+	}
+
 	for _, queue := range bus.queues {
 		close(queue.Relay)
 	}
@@ -125,61 +270,205 @@ func (bus *EventBus) Shutdown() {
 	close(bus.eventRequests)
 }
 
-func (bus *EventBus) Subscribe(subscriber EventSource, event string, source EventSource) {
-	bus.subscribeRequests <- Subscription{subscriber, event, source}
+func (bus *EventBus) Subscribe(subscriber EventSource, event string, source EventSource, priority int) {
+	subscription := Subscription{subscriber, event, source, priority}
+
+	if bus.synchronous {
+		bus.mutex.Lock()
+		bus.subscribe(subscription)
+		bus.mutex.Unlock()
+		return
+	}
+
+	bus.subscribeRequests <- subscription
 }
 
 func (bus *EventBus) Unsubscribe(subscriber EventSource, event string, source EventSource) {
-	bus.unsubscribeRequests <- Cancellation{Subscription{subscriber, event, source}}
+	cancellation := Cancellation{Subscription{subscriber, event, source, 0}}
+
+	if bus.synchronous {
+		bus.mutex.Lock()
+		bus.unsubscribe(cancellation)
+		bus.mutex.Unlock()
+		return
+	}
+
+	bus.unsubscribeRequests <- cancellation
 }
 
 func (bus *EventBus) Trigger(event Event, source EventSource) {
+	bus.mutex.Lock()
+	replaying := bus.replaying
+	bus.mutex.Unlock()
+
+	// a replayed recording already contains the events triggered by handlers
+	if !replaying {
+		bus.trigger(event, source)
+	}
+}
+
+// Triggers a replayed event, see SetReplaying
+func (bus *EventBus) Inject(event Event, source EventSource) {
+	bus.trigger(event, source)
+}
+
+// Sets the recorder that receives all events from now on, or nil to stop recording
+func (bus *EventBus) SetRecorder(recorder EventRecorder) {
+	bus.mutex.Lock()
+	bus.recorder = recorder
+	bus.mutex.Unlock()
+}
+
+// While replaying, triggered events are dropped and only injected events are delivered
+func (bus *EventBus) SetReplaying(replaying bool) {
+	bus.mutex.Lock()
+	bus.replaying = replaying
+	bus.mutex.Unlock()
+}
+
+func (bus *EventBus) record(event EventMessage) {
+	bus.mutex.Lock()
+	recorder := bus.recorder
+	bus.mutex.Unlock()
+
+	if recorder != nil {
+		recorder.Record(event)
+	}
+}
+
+func (bus *EventBus) trigger(event Event, source EventSource) {
+	if bus.synchronous {
+		bus.mutex.Lock()
+		bus.pending = append(bus.pending, EventMessage{event, source})
+		bus.mutex.Unlock()
+		return
+	}
+
 	bus.eventRequests <- EventMessage{event, source}
 }
 
+// Delivers the events queued in synchronous mode to their subscribers in the order they have
+// been triggered. Events triggered while dispatching are delivered by the next call.
+// Does nothing if the bus is not synchronous.
+func (bus *EventBus) Dispatch() {
+	if !bus.synchronous {
+		return
+	}
+
+	bus.mutex.Lock()
+	pending := bus.pending
+	bus.pending = make([]EventMessage, 0, cap(pending))
+	bus.mutex.Unlock()
+
+	for _, event := range pending {
+		bus.record(event)
+
+		// handlers may subscribe and unsubscribe while the event propagates
+		bus.mutex.Lock()
+		var subscribers []Subscription
+		if queue, ok := getQueueForEvent(bus, event.Content.EventName()); ok {
+			subscribers = make([]Subscription, len(queue.Subscribers))
+			copy(subscribers, queue.Subscribers)
+		}
+		bus.mutex.Unlock()
+
+		propagate(subscribers, event)
+	}
+}
+
 func (bus *EventBus) Run() {
 	for bus.queues != nil {
 		select {
 		case subscription, ok := <-bus.subscribeRequests:
 			if ok {
-				queue := getQueueOrCreate(bus, subscription.EventType, subscription.Source)
-				queue.Relay <- subscription
+				bus.subscribe(subscription)
 			}
 		case cancellation, ok := <-bus.unsubscribeRequests:
 			if ok {
-				queue := getQueueOrCreate(bus, cancellation.EventType, cancellation.Source)
-				queue.Relay <- cancellation
+				bus.unsubscribe(cancellation)
 			}
 		case event, ok := <-bus.eventRequests:
 			if ok {
-				if generalQueue, ok := getQueue(bus, event.Content.EventName(), nil); ok {
-					generalQueue.Relay <- event
-				}
-
-				if specificQueue, ok := getQueue(bus, event.Content.EventName(), event.Source); ok {
-					specificQueue.Relay <- event
+				bus.record(event)
+				if queue, ok := getQueueForEvent(bus, event.Content.EventName()); ok {
+					queue.send(event)
 				}
 			}
 		}
 	}
 }
 
-func getQueue(bus *EventBus, event string, source EventSource) (*EventQueue, bool) {
-	queueName := QueueName(event, source)
-	queue, ok := bus.queues[queueName]
-	if !ok {
-		return nil, false
+func (bus *EventBus) subscribe(subscription Subscription) {
+	if !IsPattern(subscription.EventType) {
+		getQueueOrCreate(bus, subscription.EventType).send(subscription)
+		return
+	}
+
+	bus.patterns = append(removeSubscription(bus.patterns, subscription), subscription)
+	for name, queue := range bus.queues {
+		if MatchEventName(subscription.EventType, name) {
+			queue.send(subscription)
+		}
+	}
+}
+
+func (bus *EventBus) unsubscribe(cancellation Cancellation) {
+	if !IsPattern(cancellation.EventType) {
+		if queue, ok := bus.queues[cancellation.EventType]; ok {
+			queue.send(cancellation)
+		}
+		return
+	}
+
+	bus.patterns = removeSubscription(bus.patterns, cancellation.Subscription)
+	for name, queue := range bus.queues {
+		if MatchEventName(cancellation.EventType, name) {
+			queue.send(cancellation)
+		}
+	}
+}
+
+func removeSubscription(subscriptions []Subscription, subscription Subscription) []Subscription {
+	for i, s := range subscriptions {
+		if s.sameAs(subscription) {
+			return append(subscriptions[:i:i], subscriptions[i+1:]...)
+		}
+	}
+	return subscriptions
+}
+
+// Returns the queue for events of the given name. Events without queue are only
+// delivered if a pattern matches them, for which the queue is created then.
+func getQueueForEvent(bus *EventBus, event string) (*EventQueue, bool) {
+	if queue, ok := bus.queues[event]; ok {
+		return queue, true
 	}
 
-	return queue, true
+	for _, pattern := range bus.patterns {
+		if MatchEventName(pattern.EventType, event) {
+			return getQueueOrCreate(bus, event), true
+		}
+	}
+
+	return nil, false
 }
 
-func getQueueOrCreate(bus *EventBus, event string, source EventSource) *EventQueue {
-	queueName := QueueName(event, source)
-	queue, ok := bus.queues[queueName]
+func getQueueOrCreate(bus *EventBus, event string) *EventQueue {
+	queue, ok := bus.queues[event]
 	if !ok {
-		queue = NewEventQueue()
-		bus.queues[queueName] = queue
+		if bus.synchronous {
+			queue = newQueue()
+		} else {
+			queue = NewEventQueue()
+		}
+		bus.queues[event] = queue
+
+		// the queue receives the events for all matching patterns, too
+		for _, pattern := range bus.patterns {
+			if MatchEventName(pattern.EventType, event) {
+				queue.send(pattern)
+			}
+		}
 	}
 
 	return queue
@@ -1,6 +1,7 @@
 package main
 
 import "fmt"
+import "strings"
 
 type Caller interface {
 	// Call this function in it's written form, i.e. with a list of expressions, where the first one is the function name
@@ -22,6 +23,9 @@ type NativeFunctionB struct {
 type Function struct {
 	Name        string
 	Dispatchers []DispatchPattern
+
+	// jump table for choosing the dispatch pattern, rebuilt whenever the patterns change
+	table *dispatchTable
 }
 
 func (f Function) String() string {
@@ -44,12 +48,19 @@ func (f *Function) AddDispatch(dp *DispatchPattern) {
 	} else {
 		f.Dispatchers = append(f.Dispatchers, *dp)
 	}
+
+	f.table = newDispatchTable(f.Dispatchers)
+}
+
+// Replaces all dispatch patterns, e.g. when the function has been reloaded
+func (f *Function) SetDispatchers(dispatchers []DispatchPattern) {
+	f.Dispatchers = dispatchers
+	f.table = newDispatchTable(f.Dispatchers)
 }
 
 type ParameterDeclaration interface {
 	ParameterName() string
 	Match(arg Data) bool
-	Bind(args List, index int, context *Context)
 	Equals(other ParameterDeclaration) bool
 	String() string
 }
@@ -57,6 +68,12 @@ type ParameterDeclaration interface {
 type DispatchPattern struct {
 	Parameters []ParameterDeclaration
 	Code       Data
+
+	// context the pattern was defined in, which encloses the context of each call
+	closure *Context
+
+	// compiled code, run with the arguments bound to the slots of the call context
+	body *Chunk
 }
 
 func (dp *DispatchPattern) String() string {
@@ -72,6 +89,16 @@ func (dp *DispatchPattern) String() string {
 	return str + " " + dp.Code.String()
 }
 
+// Returns the parameter list of this pattern as written in the function definition
+func (dp *DispatchPattern) Signature() string {
+	params := make([]string, len(dp.Parameters))
+	for i, param := range dp.Parameters {
+		params[i] = param.String()
+	}
+
+	return "[" + strings.Join(params, " ") + "]"
+}
+
 // Two dispatch patterns are equal if their patterns are equivalent (Code is not considered)
 func (dp DispatchPattern) Equals(other DispatchPattern) bool {
 	if len(dp.Parameters) != len(other.Parameters) {
@@ -87,33 +114,58 @@ func (dp DispatchPattern) Equals(other DispatchPattern) bool {
 	return true
 }
 
-// Attempts to match a list of arguments to this dispatch pattern
-// ignores the first list item, assuming it's the function name
-func (dp DispatchPattern) Match(args List) bool {
-	if len(dp.Parameters) > args.Len() {
+// Attempts to match the arguments to this dispatch pattern
+func (dp *DispatchPattern) Match(args []Data) bool {
+	required := len(dp.Parameters)
+
+	// a sink as last parameter accepts any number of remaining arguments
+	variadic := false
+	if required > 0 {
+		_, variadic = dp.Parameters[required-1].(ArgumentSink)
+	}
+	if variadic {
+		required--
+	}
+
+	if len(args) < required || (!variadic && len(args) > required) {
 		return false
 	}
 
-	i := 0
-	for e := args.Front(); e != nil && i < len(dp.Parameters); e = e.Next() {
-		arg := e.Value.(Data)
-		if !dp.Parameters[i].Match(arg) {
+	for i := 0; i < required; i++ {
+		if !dp.Parameters[i].Match(args[i]) {
 			return false
 		}
-		i++
 	}
 
-	// Are there still arguments left that were not matched?
-	if i < args.Len() {
-		// Check if the last parameter is a sink
-		if _, isSink := dp.Parameters[i-1].(ArgumentSink); isSink {
-			return true
-		} else {
-			return false
+	return true
+}
+
+// Creates the context for a call, in which each parameter is bound to a slot
+func (dp *DispatchPattern) bind(args []Data) *Context {
+	slots := make([]Data, len(dp.Parameters))
+	for i, param := range dp.Parameters {
+		if _, isSink := param.(ArgumentSink); isSink {
+			// binds arguments i and all following as a list
+			rest := MakeList(args[i:]...)
+			rest.evaluated = true
+			slots[i] = rest
+			break
 		}
+
+		slots[i] = args[i]
 	}
 
-	return true
+	// the call context is lexically scoped by the context the function has been defined in
+	return NewSlotContext(dp.closure, dp.body.Locals, slots)
+}
+
+// Returns the names of the parameters in slot order, unnamed parameters have empty names
+func (dp *DispatchPattern) slotNames() []string {
+	names := make([]string, len(dp.Parameters))
+	for i, param := range dp.Parameters {
+		names[i] = param.ParameterName()
+	}
+	return names
 }
 
 // pattern for a regular function argument
@@ -146,22 +198,16 @@ func (ap ArgumentPattern) String() string {
 
 func (ap ArgumentPattern) Equals(other ParameterDeclaration) bool {
 	if otherAp, ok := other.(ArgumentPattern); ok {
-		types := (ap.ExpectedType == nil && otherAp.ExpectedType == nil) || ap.ExpectedType.Equals(otherAp.ExpectedType)
-		values := (ap.ExpectedValue == nil && otherAp.ExpectedValue == nil) || ap.ExpectedValue.Equals(otherAp.ExpectedValue)
+		types := ap.ExpectedType == otherAp.ExpectedType ||
+			(ap.ExpectedType != nil && otherAp.ExpectedType != nil && ap.ExpectedType.Equals(*otherAp.ExpectedType))
+		values := (ap.ExpectedValue == nil && otherAp.ExpectedValue == nil) ||
+			(ap.ExpectedValue != nil && otherAp.ExpectedValue != nil && ap.ExpectedValue.Equals(otherAp.ExpectedValue))
 		return types && values
 	}
 
 	return false
 }
 
-func (ap ArgumentPattern) Bind(args List, index int, context *Context) {
-	if ap.Name != "" {
-		context.Define(Symbol{ap.Name}, args.Get(index))
-	} else {
-		// nothing to bind since the expected value is known to the user
-	}
-}
-
 func (ap ArgumentPattern) Match(param Data) bool {
 	// check for a required value
 	if ap.ExpectedValue != nil {
@@ -189,7 +235,7 @@ type ArgumentSink struct {
 }
 
 func (as ArgumentSink) String() string {
-	return as.Name
+	return "& " + as.Name
 }
 
 func (as ArgumentSink) Equals(pd ParameterDeclaration) bool {
@@ -200,11 +246,6 @@ func (as ArgumentSink) Equals(pd ParameterDeclaration) bool {
 	return false
 }
 
-func (as ArgumentSink) Bind(args List, index int, context *Context) {
-	// binds arguments i and all following as a list
-	context.Define(Symbol{as.Name}, args.SliceFrom(index))
-}
-
 func (as ArgumentSink) Match(param Data) bool {
 	return true
 }
@@ -223,7 +264,18 @@ func (fn NativeFunction) String() string {
 }
 
 func (fn NativeFunctionB) Call(args List, context *Context) Data {
-	return fn.Function(args, context)
+	result := fn.Function(args, context)
+
+	// special forms leave the evaluation of their tail expression to the caller
+	if tail, ok := result.(*TailExpression); ok {
+		value, err := Evaluate(tail.Code, tail.Context)
+		if err != nil {
+			panic(err)
+		}
+		return value
+	}
+
+	return result
 }
 
 func (fn NativeFunctionB) String() string {
@@ -234,31 +286,45 @@ func (fn NativeFunctionB) String() string {
 // (defn myfunction [p1 p2 ...] (stmts*))
 func CreateFunction(args List, context *Context) *Function {
 	ValidateArgs(args, []string{"Symbol", "List", "Data"})
-	fn := new(Function)
 
-	// function name
+	dispatcher := NewDispatchPattern(args.Second().(List), args.Third(), context)
+	dispatcher.body = CompileFunctionBody(dispatcher, nil, context)
+
+	fn := new(Function)
 	fn.Name = args.First().(Symbol).Value
+	fn.SetDispatchers([]DispatchPattern{*dispatcher})
 
-	// create dispatch pattern
-	fnArgs := args.Second().(List)
-	if first, isSymbol := fnArgs.Get(0).(Symbol); isSymbol {
-		if first.Value == "list" {
-			fnArgs = fnArgs.SliceFrom(1)
-		}
-	}
+	return fn
+}
+
+// Creates a dispatch pattern from the parameter list of a function definition.
+// Its body has yet to be compiled.
+func NewDispatchPattern(params List, code Data, context *Context) *DispatchPattern {
+	params = LiteralItems(params)
 
-	count := fnArgs.Len()
 	dispatcher := new(DispatchPattern)
-	dispatcher.Parameters = make([]ParameterDeclaration, count)
-	for i := 0; i < count; i++ {
-		dispatcher.Parameters[i] = CreateParameter(fnArgs.Get(i), context)
-	}
-	dispatcher.Code = args.Third()
+	dispatcher.Parameters = make([]ParameterDeclaration, 0, params.Len())
+	for e := params.Front(); e != nil; e = e.Next() {
+		// [x & rest] binds all remaining arguments to rest
+		if symbol, ok := e.Value.(Symbol); ok && symbol.Value == "&" {
+			if e.Next() == nil || e.Next().Next() != nil {
+				panic("& must be followed by exactly one parameter name")
+			}
+			sink, ok := e.Next().Value.(Symbol)
+			if !ok {
+				panic("& must be followed by exactly one parameter name")
+			}
 
-	fn.Dispatchers = make([]DispatchPattern, 1)
-	fn.Dispatchers[0] = *dispatcher
+			dispatcher.Parameters = append(dispatcher.Parameters, ArgumentSink{sink.Value})
+			break
+		}
 
-	return fn
+		dispatcher.Parameters = append(dispatcher.Parameters, CreateParameter(e.Value.(Data), context))
+	}
+	dispatcher.Code = code
+	dispatcher.closure = context
+
+	return dispatcher
 }
 
 func CreateParameter(args Data, context *Context) ParameterDeclaration {
@@ -282,7 +348,7 @@ func CreateParameter(args Data, context *Context) ParameterDeclaration {
 
 		temp, err := Evaluate(t.Second(), context)
 		if err != nil {
-			panic(err.Error())
+			panic(err)
 		}
 		typ, ok := temp.(DataType)
 		if !ok {
@@ -298,43 +364,237 @@ func CreateParameter(args Data, context *Context) ParameterDeclaration {
 	panic(fmt.Sprintf("Couldn't create parameter from %s", args.String()))
 }
 
-func (fn Function) selectDispatch(args List) *DispatchPattern {
-	for _, dispatch := range fn.Dispatchers {
-		if dispatch.Match(args) {
-			return &dispatch
-		}
+func (fn *Function) selectDispatch(args []Data) *DispatchPattern {
+	if index := fn.table.lookUp(args, fn.Dispatchers); index >= 0 {
+		return &fn.Dispatchers[index]
 	}
 
-	return nil
-}
-
-func (dp DispatchPattern) bindParameters(args List, context *Context) {
-	for i, decl := range dp.Parameters {
-		decl.Bind(args, i, context)
-	}
+	panic(fmt.Sprintf("No dispatch pattern of %s matches the arguments %s", fn.Name, MakeList(args...)))
 }
 
 // ($name args...)
-func (fn Function) Call(args List, env *Context) Data {
+func (fn *Function) Call(args List, env *Context) Data {
 	// evaluate the arguments
 	args = args.Map(__evalArgs(env))
+	return fn.Apply(args)
+}
+
+// Calls the function with arguments that have already been evaluated
+func (fn *Function) Apply(args List) Data {
+	values := make([]Data, 0, args.Len())
+	args.Foreach(func(arg Data, i int) {
+		values = append(values, arg)
+	})
 
-	// create the function context for this call
-	context := NewContext()
-	context.parent = env
+	dispatch := fn.selectDispatch(values)
+	result, err := run(dispatch.body, dispatch.bind(values), &activation{fn.Name, dispatch})
+	if err != nil {
+		panic(err)
+	}
+
+	return result
+}
 
-	// choose dispatcher
-	dispatch := fn.selectDispatch(args)
-	if dispatch == nil {
-		panic("No dispatch pattern matches the given function arguments")
+// Calls any function with arguments that have already been evaluated
+func CallWithValues(fn Caller, args List, context *Context) Data {
+	switch t := fn.(type) {
+	case *Function:
+		return t.Apply(args)
+	case NativeFunction:
+		return t.Function(args, context)
 	}
-	dispatch.bindParameters(args, context)
 
-	// execute the args in the temporary context
-	result, err := Evaluate(dispatch.Code, context)
+	return fn.Call(args, context)
+}
+
+// Macros are functions which receive their arguments unevaluated and return
+// code, that is evaluated in place of the macro call
+type Macro struct {
+	Function *Function
+}
+
+func (m *Macro) String() string {
+	return "Macro<" + m.Function.Name + ">"
+}
+
+func (m *Macro) Equals(other Data) bool {
+	return m == other
+}
+
+func (m *Macro) GetType() DataType {
+	return MacroType
+}
+
+// Returns the code the macro call with given arguments expands to
+func (m *Macro) Expand(args List) Data {
+	return m.Function.Apply(args)
+}
+
+func (m *Macro) Call(args List, context *Context) Data {
+	result, err := Evaluate(m.Expand(args), context)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to call %s: %s", fn.Name, err))
+		panic(err)
 	}
 
 	return result
 }
+
+// Expands the form repeatedly as long as it is a macro call
+func MacroExpand(form Data, context *Context) Data {
+	for {
+		list, ok := form.(List)
+		if !ok || list.evaluated || list.Len() == 0 {
+			return form
+		}
+
+		symbol, ok := list.First().(Symbol)
+		if !ok {
+			return form
+		}
+
+		macro, ok := context.LookUp(symbol).(*Macro)
+		if !ok {
+			return form
+		}
+
+		form = macro.Expand(list.SliceFrom(1))
+	}
+}
+
+// Jump table that preselects the dispatch patterns which may match a call by its
+// first argument, so that only those have to be checked in order of definition
+type dispatchTable struct {
+	// candidates for calls without arguments
+	empty []int
+
+	// candidates for first arguments of a certain type and value, and of a certain type
+	byValue map[string][]int
+	byType  map[string][]int
+
+	// candidates for first arguments of other types
+	any []int
+}
+
+func newDispatchTable(dispatchers []DispatchPattern) *dispatchTable {
+	table := &dispatchTable{
+		byValue: make(map[string][]int),
+		byType:  make(map[string][]int),
+	}
+
+	accepts := func(dp DispatchPattern, typ DataType, value Data) bool {
+		if len(dp.Parameters) == 0 {
+			return false
+		}
+		if value != nil {
+			return dp.Parameters[0].Match(value)
+		}
+		if ap, ok := dp.Parameters[0].(ArgumentPattern); ok {
+			if ap.ExpectedValue != nil {
+				// values other than literals may equal arguments of any type
+				_, literal := dispatchKey(ap.ExpectedValue)
+				return !literal
+			}
+			return ap.ExpectedType == nil || ap.ExpectedType.Equals(typ)
+		}
+		return true
+	}
+
+	// collect the keys for all values and types dispatched on
+	values := make(map[string]Data)
+	types := make(map[string]DataType)
+	for i, dp := range dispatchers {
+		if dp.Match(nil) {
+			table.empty = append(table.empty, i)
+		}
+
+		if len(dp.Parameters) == 0 {
+			continue
+		}
+
+		if ap, ok := dp.Parameters[0].(ArgumentPattern); ok {
+			if _, literal := dispatchKey(ap.ExpectedValue); literal {
+				for _, value := range dispatchValues(ap.ExpectedValue) {
+					key, _ := dispatchKey(value)
+					values[key] = value
+				}
+			} else if ap.ExpectedValue != nil {
+				table.any = append(table.any, i)
+			} else if ap.ExpectedType != nil {
+				types[ap.ExpectedType.TypeName] = *ap.ExpectedType
+			} else {
+				table.any = append(table.any, i)
+			}
+		} else {
+			table.any = append(table.any, i)
+		}
+	}
+
+	for key, value := range values {
+		for i, dp := range dispatchers {
+			if accepts(dp, value.GetType(), value) {
+				table.byValue[key] = append(table.byValue[key], i)
+			}
+		}
+	}
+
+	for key, typ := range types {
+		for i, dp := range dispatchers {
+			if accepts(dp, typ, nil) {
+				table.byType[key] = append(table.byType[key], i)
+			}
+		}
+	}
+
+	return table
+}
+
+// values which are equal to the given literal, i.e. numbers are equal as Int and Float
+func dispatchValues(value Data) []Data {
+	switch t := value.(type) {
+	case Int:
+		return []Data{t, Float{float64(t.Value)}}
+	case Float:
+		if t.Value == float64(int(t.Value)) {
+			return []Data{t, Int{int(t.Value)}}
+		}
+	}
+
+	return []Data{value}
+}
+
+// Returns the key of literals in byValue. Other values are only dispatched on by type.
+func dispatchKey(value Data) (string, bool) {
+	switch value.(type) {
+	case Int, Float, String, Keyword, Bool, Nothing:
+		return value.GetType().TypeName + ":" + value.String(), true
+	}
+
+	return "", false
+}
+
+// Returns the index of the first dispatch pattern matching the arguments or -1
+func (table *dispatchTable) lookUp(args []Data, dispatchers []DispatchPattern) int {
+	candidates := table.empty
+
+	if len(args) > 0 {
+		var ok bool
+		if len(table.byValue) > 0 {
+			if key, literal := dispatchKey(args[0]); literal {
+				candidates, ok = table.byValue[key]
+			}
+		}
+		if !ok {
+			if candidates, ok = table.byType[args[0].GetType().TypeName]; !ok {
+				candidates = table.any
+			}
+		}
+	}
+
+	for _, index := range candidates {
+		if dispatchers[index].Match(args) {
+			return index
+		}
+	}
+
+	return -1
+}
@@ -1,50 +1,241 @@
 package main
 
-import glfw "github.com/go-gl/glfw3"
-import glu "github.com/go-gl/glu"
-import gl "github.com/go-gl/gl"
 import "fmt"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// set by command line flags: run without window, and stop after a number of frames (0 = until quit)
+var Headless = false
+var MaxFrames = 0
+
+// updates per second of game time, set by command line flag
+var UpdateRate = 60.0
+
+// the most updates run before rendering a frame, the game slows down if it cannot keep up
+var MaxFrameSkip = 5
+
+// shows the frame number in the window title, set by command line flag
+var DebugTitle = false
+
+// file names the frames of a headless game are rendered into, e.g. frames/%04d.png, set by
+// command line flag
+var RenderPNGPath = ""
 
-var gamehost_Window *glfw.Window
 var gamehost_world = NewWorld()
 
-func RunGamehost() {
-	if !glfw.Init() {
-		panic("Cannot init GLFW")
+// set by QuitGamehost, accessed atomically
+var gamehost_quit int32
+
+// Stops the gamehost after the current frame
+func QuitGamehost() {
+	atomic.StoreInt32(&gamehost_quit, 1)
+}
+
+func gamehost_running(backend RenderBackend, frame int) bool {
+	if atomic.LoadInt32(&gamehost_quit) != 0 || backend.ShouldClose() {
+		return false
 	}
+	return MaxFrames <= 0 || frame < MaxFrames
+}
+
+// The game is updated in fixed time steps of Delta seconds, as often as the real time that has
+// passed requires. Headless games with a fixed number of frames are updated without waiting.
+type GameClock struct {
+	Frame   int
+	Delta   float64
+	Elapsed float64
+
+	mutex sync.RWMutex
+}
 
-	defer glfw.Terminate()
+var gamehost_clock = new(GameClock)
 
-	window, err := glfw.CreateWindow(800, 600, "Apollo", nil, nil)
+func (clock *GameClock) reset(delta float64) {
+	clock.mutex.Lock()
+	clock.Frame, clock.Delta, clock.Elapsed = 0, delta, 0
+	clock.mutex.Unlock()
+}
+
+// advances the clock by one update and returns the number of the new frame
+func (clock *GameClock) step() int {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	clock.Frame++
+	clock.Elapsed = float64(clock.Frame) * clock.Delta
+	return clock.Frame
+}
+
+// Returns the frame number, the time step and the game time elapsed since the start
+func (clock *GameClock) Now() (frame int, delta float64, elapsed float64) {
+	clock.mutex.RLock()
+	defer clock.mutex.RUnlock()
+
+	return clock.Frame, clock.Delta, clock.Elapsed
+}
+
+func RunGamehost() {
+	step, err := updateStep(UpdateRate)
 	if err != nil {
 		panic(err)
 	}
 
-	window.MakeContextCurrent()
-	gamehost_Window = window
+	// a quit from an earlier run doesn't stop this one
+	atomic.StoreInt32(&gamehost_quit, 0)
+
+	var backend RenderBackend
+	switch {
+	case Headless && RenderPNGPath != "":
+		backend = NewPNGBackend(RenderPNGPath, 800, 600)
+	case Headless:
+		backend = new(HeadlessBackend)
+	default:
+		backend = NewGLBackend()
+	}
+
+	if err := backend.Open(); err != nil {
+		panic(err)
+	}
+	defer backend.Close()
 
-	gl.ClearColor(1, 1, 1, 1)
-	glu.LookAt(0, 1.5, 5, 0, 0, 0, 0, 1, 0)
+	gamehost_clock.reset(step.Seconds())
 	frame := 0
+	eventBus := MainContext.GetEventBus()
+
+	recording, replay, err := startRecordingAndReplay(eventBus, MainContext)
+	if err != nil {
+		panic(err)
+	}
+	if recording != nil {
+		defer func() {
+			eventBus.SetRecorder(nil)
+			recording.Close()
+		}()
+	}
 
-	EvaluateString("(trigger GAMEHOST Init!)", MainContext)
+	if _, err := EvaluateString("(trigger GAMEHOST Init!)", MainContext); err != nil {
+		fmt.Println(err.Error())
+	}
+	gamehost_replay(replay, frame)
+	eventBus.Dispatch()
 
 	gamehost_world.Create(CreateCube(0, 0, 0))
 
-	for !gamehost_Window.ShouldClose() {
-		gl.Clear(gl.COLOR_BUFFER_BIT)
-		gl.LoadIdentity()
-		gamehost_Window.SetTitle(fmt.Sprintf("Frame #%v", frame))
-		frame++
+	// real time that has passed but not been simulated yet
+	accumulated := time.Duration(0)
+	last := time.Now()
 
-		EvaluateString("(gameloop 0.016)", MainContext)
+	// e.g. tests and benchmarks run their frames without being paced by the real time
+	unpaced := Headless && MaxFrames > 0
 
-		gamehost_world.Render()
-		graphicsQueue.Process()
+	for gamehost_running(backend, frame) {
+		if unpaced {
+			accumulated = step
+		} else {
+			now := time.Now()
+			accumulated += now.Sub(last)
+			last = now
+		}
 
-		gamehost_Window.SwapBuffers()
-		glfw.PollEvents()
+		updates := 0
+		for accumulated >= step && updates < MaxFrameSkip && gamehost_running(backend, frame) {
+			frame = gamehost_clock.step()
+			gamehost_update(frame, step.Seconds(), recording, replay)
+
+			accumulated -= step
+			updates++
+		}
+
+		// drops the time the game couldn't catch up with rather than falling further behind
+		if updates == MaxFrameSkip && accumulated >= step {
+			accumulated = 0
+		}
+
+		if DebugTitle {
+			backend.SetTitle(fmt.Sprintf("Frame #%v", frame))
+		}
+
+		// the fraction of a time step that has passed since the last update
+		alpha := float64(accumulated) / float64(step)
+		backend.Render(gamehost_world, alpha)
+
+		// without vsync to wait for, headless games would spin until the next update
+		if Headless && updates == 0 {
+			time.Sleep(step - accumulated)
+		}
+	}
+
+	if recording != nil {
+		recording.SetFrame(frame + 1)
+	}
+
+	if _, err := EvaluateString("(trigger GAMEHOST Shutdown!)", MainContext); err != nil {
+		fmt.Println(err.Error())
+	}
+	gamehost_replay(replay, frame+1)
+	eventBus.Dispatch()
+}
+
+// Returns the time step of the given updates per second
+func updateStep(rate float64) (time.Duration, error) {
+	if !(rate > 0) || time.Duration(float64(time.Second)/rate) <= 0 {
+		return 0, fmt.Errorf("Invalid update rate %v, expected a positive number of updates per second", rate)
+	}
+
+	return time.Duration(float64(time.Second) / rate), nil
+}
+
+// runs one update of the game with the time step dt
+func gamehost_update(frame int, dt float64, recording *EventRecording, replay *EventReplay) {
+	if recording != nil {
+		recording.SetFrame(frame)
 	}
+	gamehost_replay(replay, frame)
+
+	if _, err := Evaluate(MakeList(Symbol{Value: "gameloop"}, Float{dt}), MainContext); err != nil {
+		fmt.Println(err.Error())
+	}
+	systemScheduler.Run(dt)
+
+	// handlers of the events triggered during the frame run before rendering
+	MainContext.GetEventBus().Dispatch()
+}
+
+// triggers the recorded events of the frame if a recording is replayed
+func gamehost_replay(replay *EventReplay, frame int) {
+	if replay == nil {
+		return
+	}
+
+	if err := replay.Replay(frame); err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+//-----------------------------------------------------------------------------
+// Native Functions for the gamehost
+
+// (quit) - stops the game after the current frame
+func _quit(args List, context *Context) Data {
+	QuitGamehost()
+	return Nothing{}
+}
+
+// (frame-number) - number of the current update, starting with 1
+func _frame_number(args List, context *Context) Data {
+	frame, _, _ := gamehost_clock.Now()
+	return Int{frame}
+}
+
+// (delta-time) - seconds of game time per update
+func _delta_time(args List, context *Context) Data {
+	_, delta, _ := gamehost_clock.Now()
+	return Float{delta}
+}
 
-	EvaluateString("(trigger GAMEHOST Shutdown!)", MainContext)
+// (elapsed-time) - seconds of game time since the game started
+func _elapsed_time(args List, context *Context) Data {
+	_, _, elapsed := gamehost_clock.Now()
+	return Float{elapsed}
 }
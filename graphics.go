@@ -1,10 +1,11 @@
 package main
 
-import gl "github.com/go-gl/gl"
+import "math"
 import "sync"
 
+// Graphics calls of scripts are queued and processed with the renderer before the next frame is rendered
 type GraphicsQueue struct {
-	calls []func()
+	calls []func(Renderer)
 }
 
 var graphicsQueue = NewGraphicsQueue()
@@ -12,24 +13,31 @@ var lock = new(sync.Mutex)
 
 func NewGraphicsQueue() *GraphicsQueue {
 	queue := new(GraphicsQueue)
-	queue.calls = make([]func(), 0, 100)
+	queue.calls = make([]func(Renderer), 0, 100)
 
 	return queue
 }
 
-func (gq *GraphicsQueue) Process() {
-	calls := make([]func(), len(gq.calls))
+func (gq *GraphicsQueue) Process(renderer Renderer) {
+	calls := make([]func(Renderer), len(gq.calls))
 	lock.Lock()
 	copy(calls, gq.calls)
-	gq.calls = make([]func(), 0, 100)
+	gq.calls = make([]func(Renderer), 0, 100)
 	lock.Unlock()
 
 	for _, call := range calls {
-		call()
+		call(renderer)
 	}
 }
 
-func (gq *GraphicsQueue) Enqueue(call func()) {
+// Drops the queued calls, e.g. if there is no graphics context to process them
+func (gq *GraphicsQueue) Clear() {
+	lock.Lock()
+	gq.calls = make([]func(Renderer), 0, 100)
+	lock.Unlock()
+}
+
+func (gq *GraphicsQueue) Enqueue(call func(Renderer)) {
 	lock.Lock()
 	gq.calls = append(gq.calls, call)
 	lock.Unlock()
@@ -41,9 +49,8 @@ func fill_background(args List, context *Context) Data {
 	blue := args.Third().(Float)
 	alpha := args.Get(3).(Float)
 
-	graphicsQueue.Enqueue(func() {
-		gl.ClearColor(gl.GLclampf(red.Value), gl.GLclampf(green.Value),
-			gl.GLclampf(blue.Value), gl.GLclampf(alpha.Value))
+	graphicsQueue.Enqueue(func(renderer Renderer) {
+		renderer.SetClearColor(Color{red.Value, green.Value, blue.Value, alpha.Value})
 	})
 
 	return Nothing{}
@@ -64,48 +71,75 @@ func (v Vertex3D) Similar(other Vertex3D) bool {
 	return (dx*dx + dy*dy + dz*dz) < 0.5
 }
 
+func (v Vertex3D) Add(other Vertex3D) Vertex3D {
+	return Vertex3D{v.X + other.X, v.Y + other.Y, v.Z + other.Z}
+}
+
+func (v Vertex3D) Sub(other Vertex3D) Vertex3D {
+	return Vertex3D{v.X - other.X, v.Y - other.Y, v.Z - other.Z}
+}
+
+func (v Vertex3D) Scale(factor float64) Vertex3D {
+	return Vertex3D{v.X * factor, v.Y * factor, v.Z * factor}
+}
+
+func (v Vertex3D) Dot(other Vertex3D) float64 {
+	return v.X*other.X + v.Y*other.Y + v.Z*other.Z
+}
+
+func (v Vertex3D) Cross(other Vertex3D) Vertex3D {
+	return Vertex3D{v.Y*other.Z - v.Z*other.Y, v.Z*other.X - v.X*other.Z, v.X*other.Y - v.Y*other.X}
+}
+
+func (v Vertex3D) Length() float64 {
+	return math.Sqrt(v.Dot(v))
+}
+
+func (v Vertex3D) Normalize() Vertex3D {
+	if length := v.Length(); length > 0 {
+		return v.Scale(1 / length)
+	}
+	return v
+}
+
 type Vertex4D struct {
 	Vertex3D
 	W float64
 }
 
-func (cube *Cube) Render() {
+// Returns the visible sides of the cube, which are coloured by its position
+func (cube *Cube) Mesh() *Mesh {
 	x, y, z := cube.Position.X, cube.Position.Y, cube.Position.Z
 
-	gl.Begin(gl.QUADS)
-
-	gl.Color3d(0.5-(x/50), 0.5-(y/50), 0.5-(z/50))
-
-	// Front Side
-	gl.TexCoord2f(0, 0)
-	gl.Vertex3d(x-0.5, y-0.5, z+0.5)
-	gl.TexCoord2f(1, 0)
-	gl.Vertex3d(x+0.5, y-0.5, z+0.5)
-	gl.TexCoord2f(1, 1)
-	gl.Vertex3d(x+0.5, y+0.5, z+0.5)
-	gl.TexCoord2f(0, 1)
-	gl.Vertex3d(x-0.5, y+0.5, z+0.5)
-
-	// Left Side
-	gl.Color3d(0.5-(x/20), 0.5-(y/20), 0.5-(z/20))
-	gl.TexCoord2f(0, 0)
-	gl.Vertex3d(x-0.5, y-0.5, z-0.5)
-	gl.TexCoord2f(1, 0)
-	gl.Vertex3d(x-0.5, y-0.5, z+0.5)
-	gl.TexCoord2f(1, 1)
-	gl.Vertex3d(x-0.5, y+0.5, z+0.5)
-	gl.TexCoord2f(0, 1)
-	gl.Vertex3d(x-0.5, y+0.5, z-0.5)
+	return &Mesh{Quads: []Quad{
+		// Front Side
+		{[4]Vertex3D{
+			{x - 0.5, y - 0.5, z + 0.5},
+			{x + 0.5, y - 0.5, z + 0.5},
+			{x + 0.5, y + 0.5, z + 0.5},
+			{x - 0.5, y + 0.5, z + 0.5},
+		}, Color{0.5 - (x / 50), 0.5 - (y / 50), 0.5 - (z / 50), 1}},
+
+		// Left Side
+		{[4]Vertex3D{
+			{x - 0.5, y - 0.5, z - 0.5},
+			{x - 0.5, y - 0.5, z + 0.5},
+			{x - 0.5, y + 0.5, z + 0.5},
+			{x - 0.5, y + 0.5, z - 0.5},
+		}, Color{0.5 - (x / 20), 0.5 - (y / 20), 0.5 - (z / 20), 1}},
+	}}
+}
 
-	gl.End()
+func (cube *Cube) Render(renderer Renderer) {
+	renderer.DrawMesh(cube.Mesh())
 }
 
-func (world *World) Render() {
+func (world *World) Render(renderer Renderer) {
 	for _, cube := range world.cubePool {
 		if !cube.used {
 			continue
 		}
 
-		cube.Render()
+		cube.Render(renderer)
 	}
 }
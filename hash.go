@@ -0,0 +1,236 @@
+package main
+
+//
+// This file contains the hashing of data by value and the hash table backing dictionaries
+//
+
+import "hash/fnv"
+import "math"
+import "strconv"
+
+// Data types implement Hasher to be used as dictionary keys and set members.
+// Values that are equal (see Data.Equals) must have equal hashes.
+type Hasher interface {
+	Hash() uint32
+}
+
+// Returns the hash of any data. Types not implementing Hasher are hashed by
+// their type and string representation.
+func HashOf(data Data) uint32 {
+	if hasher, ok := data.(Hasher); ok {
+		return hasher.Hash()
+	}
+
+	return hashString(data.GetType().TypeName + ":" + data.String())
+}
+
+func hashString(str string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(str))
+	return hash.Sum32()
+}
+
+// lists, vectors and persistent vectors with equal items are equal
+func hashSequence(items []Data) uint32 {
+	hash := uint32(1)
+	for _, item := range items {
+		hash = 31*hash + HashOf(item)
+	}
+	return hash
+}
+
+// combines the hashes of key-value pairs independently of their order
+func hashEntry(key Data, value Data) uint32 {
+	return HashOf(key) ^ (HashOf(value) * 16777619)
+}
+
+func (x Int) Hash() uint32 {
+	return hashString("Int:" + strconv.Itoa(x.Value))
+}
+
+func (x Float) Hash() uint32 {
+	// floats are equal to ints if they have no fractional part. MaxInt rounds up to the
+	// next float, which is out of range already.
+	if x.Value == math.Trunc(x.Value) && x.Value >= math.MinInt && x.Value < math.MaxInt {
+		return Int{int(x.Value)}.Hash()
+	}
+
+	return hashString("Float:" + strconv.FormatFloat(x.Value, 'g', -1, 64))
+}
+
+func (x String) Hash() uint32 {
+	return hashString("String:" + x.Value)
+}
+
+func (x Keyword) Hash() uint32 {
+	return hashString("Keyword:" + x.Value)
+}
+
+func (x Symbol) Hash() uint32 {
+	return hashString("Symbol:" + x.Value)
+}
+
+func (x Bool) Hash() uint32 {
+	if x.Value {
+		return 1231
+	}
+	return 1237
+}
+
+func (x Nothing) Hash() uint32 {
+	return 0
+}
+
+func (x List) Hash() uint32 {
+	items := make([]Data, 0, x.Len())
+	x.Foreach(func(item Data, i int) {
+		items = append(items, item)
+	})
+	return hashSequence(items)
+}
+
+func (x Vector) Hash() uint32 {
+	return hashSequence(x.Items())
+}
+
+func (x Dict) Hash() uint32 {
+	hash := uint32(0)
+	x.Foreach(func(key Data, value Data) {
+		hash += hashEntry(key, value)
+	})
+	return hash
+}
+
+func (x PersistentVector) Hash() uint32 {
+	return hashSequence(x.Items())
+}
+
+func (x PersistentMap) Hash() uint32 {
+	hash := uint32(0)
+	x.Foreach(func(key Data, value Data) {
+		hash += hashEntry(key, value)
+	})
+	return hash
+}
+
+func (x PersistentSet) Hash() uint32 {
+	hash := uint32(0)
+	x.Foreach(func(item Data) {
+		hash += HashOf(item)
+	})
+	return hash
+}
+
+func (e *Entity) Hash() uint32 {
+	return uint32(e.id) ^ uint32(e.id>>32)
+}
+
+//=============================================================================
+// Hash table
+//=============================================================================
+
+// hashTable maps keys to values by their hash and equality.
+// Entries are iterated in the order they have been inserted.
+type hashTable struct {
+	entries []tableEntry
+
+	// indices of the entries by hash
+	index map[uint32][]int
+
+	// number of entries that have not been removed
+	count int
+}
+
+type tableEntry struct {
+	key   Data
+	value Data
+
+	// removed entries remain until the table is compacted
+	removed bool
+}
+
+func newHashTable() *hashTable {
+	return &hashTable{index: make(map[uint32][]int)}
+}
+
+// returns the position of the key in entries or -1
+func (table *hashTable) find(hash uint32, key Data) int {
+	for _, i := range table.index[hash] {
+		if table.entries[i].key.Equals(key) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (table *hashTable) get(key Data) (Data, bool) {
+	if i := table.find(HashOf(key), key); i >= 0 {
+		return table.entries[i].value, true
+	}
+	return nil, false
+}
+
+func (table *hashTable) put(key Data, value Data) {
+	hash := HashOf(key)
+	if i := table.find(hash, key); i >= 0 {
+		table.entries[i].value = value
+		return
+	}
+
+	table.index[hash] = append(table.index[hash], len(table.entries))
+	table.entries = append(table.entries, tableEntry{key: key, value: value})
+	table.count++
+}
+
+func (table *hashTable) remove(key Data) bool {
+	hash := HashOf(key)
+	i := table.find(hash, key)
+	if i < 0 {
+		return false
+	}
+
+	table.entries[i] = tableEntry{removed: true}
+	table.count--
+
+	bucket := table.index[hash]
+	for j, index := range bucket {
+		if index == i {
+			bucket = append(bucket[:j], bucket[j+1:]...)
+			break
+		}
+	}
+	if len(bucket) == 0 {
+		delete(table.index, hash)
+	} else {
+		table.index[hash] = bucket
+	}
+
+	// drop the removed entries once they make up half of the table
+	if len(table.entries) > 8 && table.count < len(table.entries)/2 {
+		table.compact()
+	}
+
+	return true
+}
+
+func (table *hashTable) compact() {
+	entries := table.entries
+	table.entries = make([]tableEntry, 0, table.count)
+	table.index = make(map[uint32][]int)
+
+	for _, entry := range entries {
+		if !entry.removed {
+			hash := HashOf(entry.key)
+			table.index[hash] = append(table.index[hash], len(table.entries))
+			table.entries = append(table.entries, entry)
+		}
+	}
+}
+
+func (table *hashTable) foreach(f func(key Data, value Data)) {
+	for i := 0; i < len(table.entries); i++ {
+		if entry := table.entries[i]; !entry.removed {
+			f(entry.key, entry.value)
+		}
+	}
+}
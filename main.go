@@ -2,15 +2,32 @@ package main
 
 import "fmt"
 import "flag"
+import "os"
 
 const VERSION = "0.1"
 
 func main() {
+	flag.BoolVar(&SynchronousEvents, "sync-events", false, "dispatch events once per frame in trigger order")
+	flag.StringVar(&RecordEventsPath, "record", "", "record all events into the given file")
+	flag.StringVar(&ReplayEventsPath, "replay", "", "replay the events recorded in the given file")
+	flag.BoolVar(&Headless, "headless", false, "run without window and graphics, e.g. on servers")
+	flag.IntVar(&MaxFrames, "frames", 0, "stop after the given number of frames (0 = until quit)")
+	flag.Float64Var(&UpdateRate, "update-rate", 60, "updates of the game per second")
+	flag.BoolVar(&DebugTitle, "debug-title", false, "show the frame number in the window title")
+	flag.StringVar(&RenderPNGPath, "render-png", "", "with -headless, render the frames into PNG files, e.g. frames/%04d.png")
 	flag.Parse()
+	if _, err := updateStep(UpdateRate); err != nil {
+		fmt.Println(err.Error())
+		os.Exit(2)
+	}
+
 	InitRuntime()
 	fmt.Printf("Apollo %s\n", VERSION)
 
-	go REPL()
+	// headless games run unattended until they quit or reach the number of frames
+	if !Headless {
+		go REPL()
+	}
 
 	if flag.NArg() == 1 {
 		var scriptfile = flag.Arg(0)
@@ -80,7 +80,7 @@ func __evalArgs(context *Context) func(data Data, i int) Data {
 	return func(data Data, i int) Data {
 		result, err := Evaluate(data, context)
 		if err != nil {
-			panic(err.Error())
+			panic(err)
 		}
 		return result
 	}
@@ -106,8 +106,7 @@ func _def(args List, context *Context) Data {
 	if err == nil {
 		context.Define(symbol, value)
 	} else {
-		fmt.Printf(err.Error())
-		return nil
+		panic(err)
 	}
 
 	return value
@@ -118,7 +117,7 @@ func _fn(args List, context *Context) Data {
 	ValidateArgs(args, []string{"Symbol", "List", "Data"}, []string{"List", "Data"})
 
 	if args.Len() < 3 {
-		args.InsertBefore(Symbol{"anonymous"}, args.Front())
+		args.InsertBefore(Symbol{Value: "anonymous"}, args.Front())
 	}
 
 	return CreateFunction(args, context)
@@ -128,9 +127,11 @@ func _fn(args List, context *Context) Data {
 func _defn(args List, context *Context) Data {
 	ValidateArgs(args, []string{"Symbol", "List", "Data"})
 
-	name := args.First().(Symbol)
-	fn := CreateFunction(args, context)
+	return defineFunction(args.First().(Symbol), CreateFunction(args, context), context)
+}
 
+// defines the function under the given name unless a native function would be overwritten
+func defineFunction(name Symbol, fn *Function, context *Context) Data {
 	def := context.LookUp(name)
 	if def == nil {
 		// define new function
@@ -151,8 +152,11 @@ func _defn(args List, context *Context) Data {
 // (fn+= name args* stmts*)
 func _extend_function(args List, context *Context) Data {
 	ValidateArgs(args, []string{"Symbol", "List", "Data"})
-	name := args.First().(Symbol)
-	fn := CreateFunction(args, context)
+	return extendFunction(args.First().(Symbol), CreateFunction(args, context), context)
+}
+
+// adds the dispatch patterns of fn to the function of the given name, which is defined if necessary
+func extendFunction(name Symbol, fn *Function, context *Context) Data {
 	def := context.LookUp(name)
 	if def == nil {
 		context.Define(name, fn)
@@ -175,6 +179,15 @@ func _list(args List, context *Context) Data {
 	return args
 }
 
+// (vector x1 x2 ...) or [x1 x2 ...]
+func _vector(args List, context *Context) Data {
+	vector := CreateVector(args.Len())
+	args.Foreach(func(item Data, i int) {
+		vector.Append(item)
+	})
+	return vector
+}
+
 // creates a dictionary. expects even number of arguments
 // (dict :key1 value1 :key2 value2 ...)
 func _dict(args List, context *Context) Data {
@@ -189,7 +202,7 @@ func _dict(args List, context *Context) Data {
 		value, _ := e.Next().Value.(Data)
 		e = e.Next()
 
-		dict.entries[key] = value
+		dict.Put(key, value)
 	}
 
 	return dict
@@ -198,7 +211,7 @@ func _dict(args List, context *Context) Data {
 // (symbol name) - return a symbol with given name
 func _symbol(args List, context *Context) Data {
 	ValidateArgs(args, []string{"String"})
-	return Symbol{args.First().(String).Value}
+	return Symbol{Value: args.First().(String).Value}
 }
 
 // (keyword name) - return a keyword with given name (prepended with a colon if not supplied)
@@ -214,18 +227,23 @@ func _keyword(args List, context *Context) Data {
 }
 
 // (get dict key)	- gets an entry from a dictionary
-// (get list index)	- gets an entry from a list
+// (get list index)	- gets an entry from a list or vector
 // returns Nothing if entry doesn't exist
 func _get(args List, context *Context) Data {
-	ValidateArgs(args, []string{"Dict", "Data"}, []string{"List", "Int"})
+	ValidateArgs(args, []string{"Dict", "Data"}, []string{"List", "Int"}, []string{"Vector", "Int"},
+		[]string{"PersistentMap", "Data"}, []string{"PersistentVector", "Int"}, []string{"PersistentSet", "Data"})
 
-	if list, ok := args.First().(List); ok {
+	switch t := args.First().(type) {
+	case PersistentMap, PersistentVector, PersistentSet:
+		return getEntry(t, args.Second())
+	case List:
 		index := args.Second().(Int)
-		return list.Get(int(index.Value))
-	}
-
-	if dict, ok := args.First().(Dict); ok {
-		if value, defined := dict.entries[args.Second()]; defined {
+		return t.Get(int(index.Value))
+	case Vector:
+		index := args.Second().(Int)
+		return t.Get(index.Value)
+	case Dict:
+		if value, defined := t.Get(args.Second()); defined {
 			return value
 		}
 	}
@@ -234,19 +252,25 @@ func _get(args List, context *Context) Data {
 }
 
 // (put dict key value) - sets the dictionary entry "key" to value
+// (put list index value) - sets the item at index of a list or vector to value
 func _put(args List, context *Context) Data {
-	ValidateArgs(args, []string{"Dict", "Data", "Data"}, []string{"List", "Int", "Data"})
+	ValidateArgs(args, []string{"Dict", "Data", "Data"}, []string{"List", "Int", "Data"}, []string{"Vector", "Int", "Data"})
 
 	if dict, ok := args.First().(Dict); ok {
 		key := args.Second()
 		value := args.Third()
-		dict.entries[key] = value
+		dict.Put(key, value)
 		return value
 	}
 
-	list := args.First().(List)
 	index := args.Second().(Int)
 	value := args.Third()
+	if vector, ok := args.First().(Vector); ok {
+		vector.Set(index.Value, value)
+		return value
+	}
+
+	list := args.First().(List)
 	list.Set(index.Value, value)
 	return value
 }
@@ -265,69 +289,125 @@ func _print(args List, context *Context) Data {
 	return Nothing{}
 }
 
-// (append list xs1 xs2 ...) - appends lists of items to the list and returns the modified list
+// (append list xs1 xs2 ...) - appends lists of items to the list or vector and returns the modified list
 func _append(args List, context *Context) Data {
 	args.RequireArity(2)
-	if list, ok := args.First().(List); ok {
+	switch t := args.First().(type) {
+	case List:
 		args.Foreach(func(data Data, i int) {
 			if i > 0 {
-				if datas, ok := data.(List); ok {
-					list.PushBackList(datas.List)
-				} else {
-					list.PushBack(data)
+				switch items := data.(type) {
+				case List:
+					t.PushBackList(items.List)
+				case Vector:
+					for _, item := range items.Items() {
+						t.PushBack(item)
+					}
+				default:
+					t.PushBack(data)
 				}
 			}
 		})
-		return list
+		return t
+	case Vector:
+		args.Foreach(func(data Data, i int) {
+			if i > 0 {
+				t.Append(sequenceItems(data)...)
+			}
+		})
+		return t
 	}
 
 	panic("First argument must be a list!")
 }
 
-// (prepend list xs1 xs2 ...) - prepends lists of items to the list and returns the modified list
+// (prepend list xs1 xs2 ...) - prepends lists of items to the list or vector and returns the modified list
 func _prepend(args List, context *Context) Data {
 	args.RequireArity(2)
-	if list, ok := args.Get(1).(List); ok {
+	switch t := args.First().(type) {
+	case List:
 		args.Foreach(func(data Data, i int) {
 			if i > 0 {
-				if datas, ok := data.(List); ok {
-					list.PushFrontList(datas.List)
-				} else {
-					list.PushFront(data)
+				switch items := data.(type) {
+				case List:
+					t.PushFrontList(items.List)
+				case Vector:
+					for j := items.Len() - 1; j >= 0; j-- {
+						t.PushFront(items.Get(j))
+					}
+				default:
+					t.PushFront(data)
 				}
 			}
 		})
-		return list
+		return t
+	case Vector:
+		args.Foreach(func(data Data, i int) {
+			if i > 0 {
+				t.Prepend(sequenceItems(data)...)
+			}
+		})
+		return t
 	}
 
 	panic("First argument must be a list!")
 }
 
+// returns the items of a list or vector, or the value itself as single item
+func sequenceItems(data Data) []Data {
+	switch t := data.(type) {
+	case Vector:
+		return t.Items()
+	case PersistentVector:
+		return t.Items()
+	case List:
+		items := make([]Data, 0, t.Len())
+		t.Foreach(func(item Data, i int) {
+			items = append(items, item)
+		})
+		return items
+	}
+
+	return []Data{data}
+}
+
 // (slice list startInl endExcl) - get all items between startIncl and endExcl
 // (slice list 0 endExcl) - get all items till end
 // (slice list startIncl) - get all items from startIncl till end
 func _slice(args List, context *Context) Data {
-	ValidateArgs(args, []string{"List", "Int", "Int"}, []string{"List", "Int"})
+	ValidateArgs(args, []string{"List", "Int", "Int"}, []string{"List", "Int"},
+		[]string{"Vector", "Int", "Int"}, []string{"Vector", "Int"})
+
+	start := args.Second().(Int)
+
+	if vector, ok := args.First().(Vector); ok {
+		if args.Len() == 3 {
+			return vector.Slice(start.Value, args.Third().(Int).Value)
+		}
+		return vector.Slice(start.Value, vector.Len())
+	}
 
 	list := args.First().(List)
 
 	if args.Len() == 3 {
-		start := args.Second().(Int)
 		end := args.Third().(Int)
 		return list.Slice(start.Value, end.Value)
 	}
 
-	start := args.Second().(Int)
 	return list.Slice(start.Value, list.Len())
 }
 
 // (apply f collection) -
 func _apply(args List, context *Context) Data {
-	ValidateArgs(args, []string{"Function", "List"}, []string{"NativeFunction", "List"})
+	ValidateArgs(args, []string{"Function", "List"}, []string{"NativeFunction", "List"},
+		[]string{"Function", "Vector"}, []string{"NativeFunction", "Vector"})
 
 	if fn, ok := args.First().(Caller); ok {
-		if list, ok := args.Second().(List); ok {
-			return fn.Call(list, context)
+		switch t := args.Second().(type) {
+		case List:
+			return CallWithValues(fn, t, context)
+		case Vector:
+			return CallWithValues(fn, MakeList(t.Items()...), context)
 		}
 	}
 
@@ -337,23 +417,45 @@ func _apply(args List, context *Context) Data {
 // (foreach collection f)
 func _foreach(args List, context *Context) Data {
 	ValidateArgs(args, []string{"List", "Function"}, []string{"List", "NativeFunction"},
-		[]string{"Dict", "Function"}, []string{"Dict", "NativeFunction"})
+		[]string{"Vector", "Function"}, []string{"Vector", "NativeFunction"},
+		[]string{"Dict", "Function"}, []string{"Dict", "NativeFunction"},
+		[]string{"PersistentVector", "Function"}, []string{"PersistentVector", "NativeFunction"},
+		[]string{"PersistentMap", "Function"}, []string{"PersistentMap", "NativeFunction"},
+		[]string{"PersistentSet", "Function"}, []string{"PersistentSet", "NativeFunction"})
+
+	f := args.Second().(Caller)
 
-	// List
-	if list, ok := args.First().(List); ok {
-		f := args.Second().(Caller)
-		list.Foreach(func(data Data, i int) {
+	switch t := args.First().(type) {
+	case List:
+		t.Foreach(func(data Data, i int) {
 			fArgs := MakeList(data)
-			f.Call(fArgs, context)
+			CallWithValues(f, fArgs, context)
 		})
-	} else {
-		// Dictionary
-		dict := args.First().(Dict)
-		for key, value := range dict.entries {
-			f := args.Second().(Caller)
+	case Vector:
+		t.Foreach(func(data Data, i int) {
+			fArgs := MakeList(data)
+			CallWithValues(f, fArgs, context)
+		})
+	case PersistentVector:
+		t.Foreach(func(data Data, i int) {
+			fArgs := MakeList(data)
+			CallWithValues(f, fArgs, context)
+		})
+	case PersistentSet:
+		t.Foreach(func(data Data) {
+			fArgs := MakeList(data)
+			CallWithValues(f, fArgs, context)
+		})
+	case Dict:
+		t.Foreach(func(key Data, value Data) {
 			fArgs := MakeList(key, value)
-			f.Call(fArgs, context)
-		}
+			CallWithValues(f, fArgs, context)
+		})
+	case PersistentMap:
+		t.Foreach(func(key Data, value Data) {
+			fArgs := MakeList(key, value)
+			CallWithValues(f, fArgs, context)
+		})
 	}
 
 	return Nothing{}
@@ -362,22 +464,34 @@ func _foreach(args List, context *Context) Data {
 // (map f collection)
 func _map(args List, context *Context) Data {
 	ValidateArgs(args, []string{"Function", "List"}, []string{"NativeFunction", "List"},
+		[]string{"Function", "Vector"}, []string{"NativeFunction", "Vector"},
+		[]string{"Function", "PersistentVector"}, []string{"NativeFunction", "PersistentVector"},
 		[]string{"Function", "Dict"}, []string{"NativeFunction", "Dict"})
 
 	fn := args.First().(Caller)
-	if list, ok := args.Second().(List); ok {
-		return list.Map(func(data Data, i int) Data {
-			fnArgs := MakeList(data)
-			return fn.Call(fnArgs, context)
+	mapping := func(data Data, i int) Data {
+		fnArgs := MakeList(data)
+		return CallWithValues(fn, fnArgs, context)
+	}
+
+	switch t := args.Second().(type) {
+	case List:
+		return t.Map(mapping)
+	case Vector:
+		return t.Map(mapping)
+	case PersistentVector:
+		results := CreatePersistentVector()
+		t.Foreach(func(data Data, i int) {
+			results = results.Conj(mapping(data, i))
 		})
-	} else {
-		dict := args.Second().(Dict)
+		return results
+	case Dict:
 		results := CreateList()
 
-		for key, value := range dict.entries {
+		t.Foreach(func(key Data, value Data) {
 			fnArgs := MakeList(key, value)
-			results.PushBack(fn.Call(fnArgs, context))
-		}
+			results.PushBack(CallWithValues(fn, fnArgs, context))
+		})
 
 		return results
 	}
@@ -388,40 +502,62 @@ func _map(args List, context *Context) Data {
 // (filter f list) - Returns a list of items for which f returns true
 func _filter(args List, context *Context) Data {
 	ValidateArgs(args, []string{"Function", "List"}, []string{"NativeFunction", "List"},
+		[]string{"Function", "Vector"}, []string{"NativeFunction", "Vector"},
+		[]string{"Function", "PersistentVector"}, []string{"NativeFunction", "PersistentVector"},
 		[]string{"Function", "Dict"}, []string{"NativeFunction", "Dict"})
 
 	fn := args.First().(Caller)
+	predicate := func(data Data, i int) bool {
+		fnArgs := MakeList(data)
+		return CallWithValues(fn, fnArgs, context).(Bool).Value
+	}
 
-	if list, ok := args.Second().(List); ok {
-		return list.Filter(func(data Data, i int) bool {
-			fnArgs := MakeList(data)
-			return fn.Call(fnArgs, context).(Bool).Value
+	switch t := args.Second().(type) {
+	case List:
+		return t.Filter(predicate)
+	case Vector:
+		return t.Filter(predicate)
+	case PersistentVector:
+		results := CreatePersistentVector()
+		t.Foreach(func(data Data, i int) {
+			if predicate(data, i) {
+				results = results.Conj(data)
+			}
 		})
-	} else {
-		dict := args.Second().(Dict)
+		return results
+	case Dict:
 		results := CreateList()
-		for key, value := range dict.entries {
+		t.Foreach(func(key Data, value Data) {
 			fnArgs := MakeList(key, value)
-			if fn.Call(fnArgs, context).(Bool).Value {
+			if CallWithValues(fn, fnArgs, context).(Bool).Value {
 				results.PushBack(value)
 			}
-		}
+		})
 		return results
 	}
 
 	return Nothing{}
 }
 
-// (len list) - Returns number of items in list
+// (len list) - Returns number of items in list or vector
 // (len dict) - Returns number of key-value pairs in dictionary
 func _len(args List, context *Context) Data {
-	ValidateArgs(args, []string{"Dict"}, []string{"List"}, []string{"String"})
+	ValidateArgs(args, []string{"Dict"}, []string{"List"}, []string{"Vector"}, []string{"String"},
+		[]string{"PersistentVector"}, []string{"PersistentMap"}, []string{"PersistentSet"})
 
 	switch t := args.First().(type) {
 	case List:
 		return Int{t.Len()}
+	case Vector:
+		return Int{t.Len()}
+	case PersistentVector:
+		return Int{t.Len()}
+	case PersistentMap:
+		return Int{t.Len()}
+	case PersistentSet:
+		return Int{t.Len()}
 	case Dict:
-		return Int{len(t.entries)}
+		return Int{t.Len()}
 	case String:
 		return Int{len(t.Value)}
 	}
@@ -450,22 +586,30 @@ func _str(args List, context *Context) Data {
 }
 
 func _first(args List, context *Context) Data {
-	ValidateArgs(args, []string{"List"})
+	ValidateArgs(args, []string{"List"}, []string{"Vector"}, []string{"PersistentVector"})
 
 	switch t := args.First().(type) {
 	case List:
 		return t.Front().Value.(Data)
+	case Vector:
+		return t.Get(0)
+	case PersistentVector:
+		return t.Get(0)
 	}
 
 	return Nothing{}
 }
 
 func _last(args List, context *Context) Data {
-	ValidateArgs(args, []string{"List"})
+	ValidateArgs(args, []string{"List"}, []string{"Vector"}, []string{"PersistentVector"})
 
 	switch t := args.First().(type) {
 	case List:
 		return t.Back().Value.(Data)
+	case Vector:
+		return t.Get(-1)
+	case PersistentVector:
+		return t.Get(-1)
 	}
 
 	return Nothing{}
@@ -477,8 +621,11 @@ func _import(args List, context *Context) Data {
 
 	// get the module
 	name := args.First().(Symbol)
-	env := context.LookUp(Symbol{"$core"}).(*Context)
-	module := GetModule(name.Value, env)
+	env := context.LookUp(Symbol{Value: "$core"}).(*Context)
+	module, err := GetModule(name.Value, env)
+	if err != nil {
+		panic(err)
+	}
 
 	// prefix (by default module name)
 	prefix := module.name
@@ -496,17 +643,23 @@ func _import(args List, context *Context) Data {
 // executes all the expressions passed in as arguments
 // returns the value of the last expression
 func _do(args List, context *Context) Data {
-	var endresult Data = nil
-	for e := args.Front(); e != nil; e = e.Next() {
-		result, err := Evaluate(e.Value.(Data), context)
-		if e.Next() == nil && err == nil {
-			endresult = result
-		} else if err != nil {
-			panic(err.Error())
+	if args.Len() == 0 {
+		return Nothing{}
+	}
+
+	for e := args.Front(); e != args.Back(); e = e.Next() {
+		if _, err := Evaluate(e.Value.(Data), context); err != nil {
+			panic(err)
 		}
 	}
 
-	return endresult
+	// the last expression is in tail position
+	return &TailExpression{args.Last(), context}
+}
+
+// evaluates all expressions like do and returns the value of the last one
+func evaluateAll(exprs List, context *Context) Data {
+	return NativeFunctionB{_do}.Call(exprs, context)
 }
 
 // (if cond ifTrue [ifFalse])
@@ -515,26 +668,17 @@ func _if(args List, context *Context) Data {
 
 	value, err := Evaluate(args.First(), context)
 	if err != nil {
-		panic("Evaluation failed")
+		panic(err)
 	}
 	boolean := value.(Bool)
 
+	// the chosen branch is in tail position
 	if boolean.Value {
-		result, err := Evaluate(args.Second(), context)
-		if err == nil {
-			return result
-		} else {
-			panic(err.Error())
-		}
+		return &TailExpression{args.Second(), context}
 	}
 
 	if args.Len() > 2 {
-		result, err := Evaluate(args.Third(), context)
-		if err == nil {
-			return result
-		} else {
-			panic(err.Error())
-		}
+		return &TailExpression{args.Third(), context}
 	}
 
 	return Nothing{}
@@ -570,6 +714,18 @@ func _code(args List, context *Context) Data {
 }
 
 func _lambda(args List, context *Context) Data {
+	params, body := lambdaDefinition(args)
+
+	fndef := CreateList()
+	fndef.PushBack(Symbol{Value: "anonymous-function-x"})
+	fndef.PushBack(params)
+	fndef.PushBack(body)
+
+	return CreateFunction(fndef, context)
+}
+
+// returns the parameters of a lambda, which are the placeholders used in its body
+func lambdaDefinition(args List) (List, List) {
 	symbols := CreateList()
 	insert := func(symbol Symbol) {
 		// if the list is empty just append
@@ -604,18 +760,13 @@ func _lambda(args List, context *Context) Data {
 	params := CreateList()
 	symbols.Foreach(func(data Data, i int) {
 		if data.(Symbol).Value == "%&" {
-			params.PushBack(Symbol{"&"})
+			params.PushBack(Symbol{Value: "&"})
 		}
 
 		params.PushBack(data)
 	})
 
-	fndef := CreateList()
-	fndef.PushBack(Symbol{"anonymous-function-x"})
-	fndef.PushBack(params)
-	fndef.PushBack(args)
-
-	return CreateFunction(fndef, context)
+	return params, args
 }
 
 func collectPlaceholders(data Data, callback func(Symbol)) {
@@ -633,39 +784,23 @@ func collectPlaceholders(data Data, callback func(Symbol)) {
 
 // (let [symbol expr symbol expr] expr*)
 func _let(args List, context *Context) Data {
-	bindings := args.First().(List)
+	bindings := LiteralItems(args.First().(List))
 	subcontext := NewContext()
 	subcontext.parent = context
 
-	// when bindings is (list ...) just remove the list symbol
-	if symbol, ok := bindings.First().(Symbol); ok && symbol.Value == "list" {
-		bindings.Remove(bindings.Front())
-	}
-
 	// iterate over bindings pair-wise to create definitions
 	for e := bindings.Front(); e != nil; e = e.Next().Next() {
 		symbol := e.Value.(Symbol)
 		value, err := Evaluate(e.Next().Value.(Data), context)
 		if err != nil {
-			panic(err.Error())
+			panic(err)
 		}
 
 		subcontext.Define(symbol, value)
 	}
 
-	var result Data
-	args.Foreach(func(elem Data, i int) {
-		if i > 0 {
-			temp, err := Evaluate(elem, subcontext)
-			if err != nil {
-				panic(err.Error())
-			} else {
-				result = temp
-			}
-		}
-	})
-
-	return result
+	// the body is evaluated like do, its last expression being in tail position
+	return _do(args.SliceFrom(1), subcontext)
 }
 
 // (range x) - collection of numbers from 0 to x
@@ -700,6 +835,93 @@ func _entity(args List, context *Context) Data {
 	return ent
 }
 
+// Triggered by an entity when it is destroyed
+var DestroyedEvent = &UserEventDefinition{Name: "Destroyed", Arguments: MakeList(Keyword{":entity"})}
+
+// Triggered by an entity when one of its components is added, changed or removed. Removed and
+// newly added components have the value Nothing.
+var PropertyChangedEvent = &UserEventDefinition{Name: "PropertyChanged",
+	Arguments: MakeList(Keyword{":property"}, Keyword{":old"}, Keyword{":new"})}
+
+// (destroy entity) - removes the components of the entity and unsubscribes its handlers,
+// returns false if it had already been destroyed
+func _destroy(args List, context *Context) Data {
+	args.RequireArity(1)
+	entity := args.First().(*Entity)
+
+	if !entity.Destroy() {
+		return Bool{false}
+	}
+
+	event := &UserEvent{DestroyedEvent, DestroyedEvent.BindArguments(MakeList(entity))}
+	context.GetEventBus().Trigger(event, entity)
+
+	return Bool{true}
+}
+
+// (alive? entity) - false once the entity has been destroyed
+func _alive(args List, context *Context) Data {
+	args.RequireArity(1)
+	return Bool{args.First().(*Entity).Alive()}
+}
+
+//-----------------------------------------------------------------------------
+// Native Functions for components
+
+// (add-component entity :name value) - returns the entity
+func _add_component(args List, context *Context) Data {
+	args.RequireArity(3)
+	entity := args.First().(*Entity)
+	entity.SetProperty(args.Second().(Keyword), args.Third(), context.GetEventBus())
+	return entity
+}
+
+// (get-component entity :name [default]) - returns Nothing or the default if the entity doesn't have the component
+func _get_component(args List, context *Context) Data {
+	args.RequireArity(2)
+	entity := args.First().(*Entity)
+
+	if value, ok := entity.Get(args.Second().(Keyword)); ok {
+		return value
+	} else if args.Len() > 2 {
+		return args.Third()
+	}
+
+	return Nothing{}
+}
+
+// (remove-component entity :name) - returns the entity
+func _remove_component(args List, context *Context) Data {
+	args.RequireArity(2)
+	entity := args.First().(*Entity)
+	entity.RemoveProperty(args.Second().(Keyword), context.GetEventBus())
+	return entity
+}
+
+// (has-component? entity :name)
+func _has_component(args List, context *Context) Data {
+	args.RequireArity(2)
+	_, ok := args.First().(*Entity).Get(args.Second().(Keyword))
+	return Bool{ok}
+}
+
+// (query :name1 :name2 ...) - returns the list of entities having all given components
+func _query(args List, context *Context) Data {
+	args.RequireArity(1)
+
+	components := make([]Keyword, 0, args.Len())
+	args.Foreach(func(arg Data, i int) {
+		components = append(components, arg.(Keyword))
+	})
+
+	entities := CreateList()
+	for _, entity := range entityComponents.query(components) {
+		entities.PushBack(entity)
+	}
+
+	return entities
+}
+
 //-----------------------------------------------------------------------------
 // Native Functions for handling evens
 
@@ -707,11 +929,17 @@ func _entity(args List, context *Context) Data {
 // e.g. (defevent Tick :dt), (defevent HealthChanged :old-amount :new-amount), ...
 func _defevent(args List, context *Context) Data {
 	name := args.First().(Symbol)
+	if events.IsPattern(name.Value) {
+		panic(fmt.Sprintf("Invalid event name %s", name.Value))
+	}
 
 	def := new(UserEventDefinition)
 	def.Name = name.Value
 	def.Arguments = args.SliceFrom(1)
 
+	// validates the parameter names
+	def.Parameters()
+
 	context.Define(name, def)
 
 	return Nothing{}
@@ -721,68 +949,332 @@ func _defevent(args List, context *Context) Data {
 // (trigger source Event value1 value2)
 func _trigger(args List, context *Context) Data {
 	eventDef := args.Second().(*UserEventDefinition)
-	eventBus := context.LookUp(Symbol{"$events"}).(NativeObject).Value.(*events.EventBus)
+	eventBus := context.LookUp(Symbol{Value: "$events"}).(NativeObject).Value.(*events.EventBus)
 
 	event := new(UserEvent)
 	event.Definition = eventDef
-
-	// TODO: Assign arguments
+	event.Arguments = eventDef.BindArguments(args.SliceFrom(2))
 
 	eventBus.Trigger(event, args.First().(*Entity))
 
 	return Nothing{}
 }
 
-// (on event callback)
+// Returns the name of the subscribed events, which are given by their definition or by a
+// pattern string such as "Input/*" for all events in a namespace or "*" for all events
+func subscribedEvents(data Data) string {
+	switch t := data.(type) {
+	case *UserEventDefinition:
+		return t.Name
+	case String:
+		return t.Value
+	}
+
+	panic(fmt.Sprintf("%s is neither an event nor a pattern", data.String()))
+}
+
+// (on event callback [priority]) - returns a subscription that can be passed to unsubscribe
 func _on(args List, context *Context) Data {
-	event := args.First().(*UserEventDefinition)
+	event := subscribedEvents(args.First())
 	callback := args.Second().(*Function)
 	eventBus := context.GetEventBus()
 
-	handler := NewUserEventHandler(NewEntity(), callback, context)
-	eventBus.Subscribe(handler, event.Name, nil)
+	priority := 0
+	if args.Len() > 2 {
+		priority = args.Third().(Int).Value
+	}
 
-	return Nothing{}
+	return SubscribeUserEvent(eventBus, NewEntity(), event, nil, callback, priority)
+}
+
+// (on-change entity :property handler [priority]) - calls (handler entity new-value old-value),
+// or (handler entity new-value) if it has two parameters, whenever the property of the entity
+// changes, returns a subscription
+func _on_change(args List, context *Context) Data {
+	entity := args.First().(*Entity)
+	property := args.Second().(Keyword)
+	callback := args.Third().(*Function)
+
+	priority := 0
+	if args.Len() > 3 {
+		priority = args.Get(3).(Int).Value
+	}
+
+	return SubscribePropertyChange(context.GetEventBus(), entity, property, callback, priority)
 }
 
-// (subscribe entity :to Event [:by entity] :handler handler)
+// (subscribe entity :to Event [:by entity] :handler handler [:priority n]) - returns a subscription
 func _subscribe(args List, context *Context) Data {
 	def := _dict(args.SliceFrom(1), context).(Dict)
 	entity := args.First().(*Entity)
 
-	event := def.GetOrDefault(Keyword{":to"}, nil).(*UserEventDefinition)
+	event := subscribedEvents(def.GetOrDefault(Keyword{":to"}, Nothing{}))
 	fn := def.GetOrDefault(Keyword{":handler"}, nil).(*Function)
-	by := def.GetOrDefault(Keyword{":by"}, nil)
-	eventBus := context.LookUp(Symbol{"$events"}).(NativeObject).Value.(*events.EventBus)
+	eventBus := context.GetEventBus()
 
-	handler := NewUserEventHandler(entity, fn, context)
+	priority := def.GetOrDefault(Keyword{":priority"}, Int{0}).(Int)
 
-	if by != nil {
-		eventBus.Subscribe(handler, event.Name, by.(*Entity))
-	} else {
-		eventBus.Subscribe(handler, event.Name, nil)
+	var by *Entity
+	if source := def.GetOrDefault(Keyword{":by"}, nil); source != nil {
+		by = source.(*Entity)
 	}
 
-	return Nothing{}
+	return SubscribeUserEvent(eventBus, entity, event, by, fn, priority.Value)
 }
 
-// (unsubscribe entity :to Event [:by entity] :handler handler)
+// (unsubscribe subscription)
+// (unsubscribe entity :to Event [:by entity] [:handler handler])
 func _unsubscribe(args List, context *Context) Data {
+	if subscription, ok := args.First().(*UserEventHandler); ok {
+		subscription.Unsubscribe()
+		return Nothing{}
+	}
+
 	def := _dict(args.SliceFrom(1), context).(Dict)
 	entity := args.First().(*Entity)
 
-	event := def.GetOrDefault(Keyword{":to"}, nil).(*UserEventDefinition)
-	fn := def.GetOrDefault(Keyword{":handler"}, nil).(*Function)
-	by := def.GetOrDefault(Keyword{":by"}, nil)
-	eventBus := context.LookUp(Symbol{"$events"}).(NativeObject).Value.(*events.EventBus)
+	event := subscribedEvents(def.GetOrDefault(Keyword{":to"}, Nothing{}))
 
-	handler := NewUserEventHandler(entity, fn, context)
+	var by *Entity
+	if source := def.GetOrDefault(Keyword{":by"}, nil); source != nil {
+		by = source.(*Entity)
+	}
 
-	if by != nil {
-		eventBus.Unsubscribe(handler, event.Name, by.(*Entity))
-	} else {
-		eventBus.Unsubscribe(handler, event.Name, nil)
+	var fn *Function
+	if handler := def.GetOrDefault(Keyword{":handler"}, nil); handler != nil {
+		fn = handler.(*Function)
+	}
+
+	for _, handler := range FindUserEventHandlers(entity, event, by, fn) {
+		handler.Unsubscribe()
+	}
+
+	return Nothing{}
+}
+
+// (unsubscribe-all entity) - removes all subscriptions of the entity
+func _unsubscribe_all(args List, context *Context) Data {
+	entity := args.First().(*Entity)
+
+	for _, handler := range FindUserEventHandlers(entity, "", nil, nil) {
+		handler.Unsubscribe()
 	}
 
 	return Nothing{}
 }
+
+// (consume-event) - returned by an event handler, stops the event from reaching handlers with lower priority
+func _consume_event(args List, context *Context) Data {
+	return EventConsumed
+}
+
+//-----------------------------------------------------------------------------
+// Native Functions for error handling
+
+// (error message [data]) - creates an error that can be thrown
+func _error(args List, context *Context) Data {
+	ValidateArgs(args, []string{"String"}, []string{"String", "Dict"})
+
+	err := &RuntimeError{Message: args.First().(String).Value, Data: CreateDict()}
+	if args.Len() > 1 {
+		err.Data = args.Second().(Dict)
+	}
+
+	return err
+}
+
+// (throw error)
+// (throw message [data])
+func _throw(args List, context *Context) Data {
+	if err, ok := args.First().(*RuntimeError); ok && args.Len() == 1 {
+		panic(err)
+	}
+
+	panic(_error(args, context))
+}
+
+// (try expr* (catch e handler*) (finally cleanup*))
+// evaluates the expressions and returns the value of the last one. If an error is
+// thrown it is bound to e and the value of the handler is returned instead.
+// The cleanup expressions are evaluated in any case.
+func _try(args List, context *Context) Data {
+	body := CreateList()
+	var catch, finally *List
+
+	args.Foreach(func(expr Data, i int) {
+		if clause, ok := expr.(List); ok && clause.Len() > 0 {
+			if symbol, ok := clause.First().(Symbol); ok {
+				switch symbol.Value {
+				case "catch":
+					handler := clause.SliceFrom(1)
+					catch = &handler
+					return
+				case "finally":
+					cleanup := clause.SliceFrom(1)
+					finally = &cleanup
+					return
+				}
+			}
+		}
+
+		body.PushBack(expr)
+	})
+
+	if finally != nil {
+		defer evaluateFinally(*finally, context)
+	}
+
+	result, err := tryDo(body, context)
+	if err == nil {
+		return result
+	} else if catch == nil {
+		panic(err)
+	}
+
+	// bind the error and handle it
+	symbol, ok := catch.First().(Symbol)
+	if !ok {
+		panic("catch expects a symbol the error is bound to")
+	}
+
+	subcontext := NewContext()
+	subcontext.parent = context
+	subcontext.Define(symbol, err)
+
+	return evaluateAll(catch.SliceFrom(1), subcontext)
+}
+
+// evaluates the cleanup expressions when try returns or panics. An error raised by the
+// cleanup does not replace the error try is panicking with already.
+func evaluateFinally(cleanup List, context *Context) {
+	original := recover()
+	if original == nil {
+		evaluateAll(cleanup, context)
+		return
+	}
+
+	tryDo(cleanup, context)
+	panic(original)
+}
+
+// evaluates expressions like do, but returns a raised error instead of panicking
+func tryDo(exprs List, context *Context) (result Data, err *RuntimeError) {
+	defer func() {
+		if e := recover(); e != nil {
+			result, err = nil, NewRuntimeError(e, nil)
+		}
+	}()
+
+	return evaluateAll(exprs, context), nil
+}
+
+// (error-message e) - returns the message of an error
+func _error_message(args List, context *Context) Data {
+	return String{requireError(args).Message}
+}
+
+// (error-data e) - returns the dictionary of additional data of an error
+func _error_data(args List, context *Context) Data {
+	return requireError(args).Data
+}
+
+// (error-stack e) - returns the stack trace of an error as list of strings
+func _error_stack(args List, context *Context) Data {
+	return requireError(args).StackTrace()
+}
+
+func requireError(args List) *RuntimeError {
+	args.RequireArity(1)
+	if err, ok := args.First().(*RuntimeError); ok {
+		return err
+	}
+
+	panic(fmt.Sprintf("%s is not an Error", args.First().String()))
+}
+
+//-----------------------------------------------------------------------------
+// Native Functions for macros
+
+// (defmacro name [params] body)
+func _defmacro(args List, context *Context) Data {
+	ValidateArgs(args, []string{"Symbol", "List", "Data"})
+
+	macro := &Macro{CreateFunction(args, context)}
+	context.Define(args.First().(Symbol), macro)
+
+	return macro
+}
+
+// (macroexpand form) - returns the code a macro call expands to
+func _macroexpand(args List, context *Context) Data {
+	args.RequireArity(1)
+	return MacroExpand(args.First(), context)
+}
+
+// (quote x) or 'x - returns x without evaluating it
+func _quote(args List, context *Context) Data {
+	args.RequireArity(1)
+	return args.First()
+}
+
+// (quasiquote x) or `x - returns x without evaluating it, except for the
+// expressions marked with (unquote x) or ~x, which are replaced by their values.
+// Lists marked with (unquote-splicing xs) or ~@xs are spliced into the containing list.
+func _quasiquote(args List, context *Context) Data {
+	args.RequireArity(1)
+	return quasiquote(args.First(), context)
+}
+
+func quasiquote(template Data, context *Context) Data {
+	list, ok := template.(List)
+	if !ok || list.Len() == 0 {
+		return template
+	}
+
+	if isForm(list, "unquote") {
+		value, err := Evaluate(list.Second(), context)
+		if err != nil {
+			panic(err)
+		}
+		return value
+	}
+
+	result := CreateList()
+	result.evaluated = list.evaluated
+	result.pos = list.pos
+
+	list.Foreach(func(item Data, i int) {
+		if splice, ok := item.(List); ok && isForm(splice, "unquote-splicing") {
+			value, err := Evaluate(splice.Second(), context)
+			if err != nil {
+				panic(err)
+			}
+
+			switch values := value.(type) {
+			case List:
+				result.PushBackList(values.List)
+			case Vector:
+				for _, value := range values.Items() {
+					result.PushBack(value)
+				}
+			default:
+				panic(fmt.Sprintf("Only lists can be spliced, found %s", value.String()))
+			}
+		} else {
+			result.PushBack(quasiquote(item, context))
+		}
+	})
+
+	return result
+}
+
+// checks whether code is a list starting with the given symbol
+func isForm(code List, name string) bool {
+	symbol, ok := code.First().(Symbol)
+	return ok && symbol.Value == name && code.Len() == 2
+}
+
+// (unquote x) - only valid within quasiquote
+func _unquote(args List, context *Context) Data {
+	panic("unquote is only allowed within quasiquote")
+}
@@ -2,9 +2,9 @@ package main
 
 import "fmt"
 import "regexp"
+import "sort"
 import "strconv"
 import "strings"
-import "errors"
 
 var whitespaceRegex = regexp.MustCompile("^\\s+")
 var stringRegex = regexp.MustCompile("^\"(?:\\.|[^\\\"]|\"\")*\"")
@@ -19,77 +19,253 @@ var placeholderRegex = regexp.MustCompile(`^%\d|%&|%$`)
 // the parsed data and the next reading position
 type ParserFunc func(input string, offset int) (Data, int)
 
+// ParseError describes invalid syntax at a certain position of the parsed input.
+// Parser functions raise it by panicking, Parse and ParseModule return it as error.
+type ParseError struct {
+	File    string
+	Line    int
+	Column  int
+	Snippet string
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	file := e.File
+	if file == "" {
+		file = "<input>"
+	}
+
+	return fmt.Sprintf("%s:%d:%d: %s near \"%s\"", file, e.Line, e.Column, e.Message, e.Snippet)
+}
+
+// Creates a parse error for the given read offset, line and column are counted from 1
+func NewParseError(input string, offset int, message string) *ParseError {
+	if offset > len(input) {
+		offset = len(input)
+	}
+
+	line := strings.Count(input[:offset], "\n") + 1
+	column := offset - strings.LastIndex(input[:offset], "\n")
+
+	// the snippet is the rest of the offending line, shortened if necessary
+	snippet := input[offset:]
+	if end := strings.IndexAny(snippet, "\r\n"); end >= 0 {
+		snippet = snippet[:end]
+	}
+	if len(snippet) > 30 {
+		snippet = snippet[:30] + "..."
+	}
+
+	return &ParseError{
+		Line:    line,
+		Column:  column,
+		Snippet: snippet,
+		Message: message,
+	}
+}
+
+// Parses a single expression
 func Parse(input string) (Data, error) {
-	defer func() {
-		if e := recover(); e != nil {
-			fmt.Printf("Parser Error: %v\n", e)
-		}
-	}()
+	return ParseNamed(input, "")
+}
+
+// Parses a single expression read from the named file, which is used in error messages
+func ParseNamed(input string, file string) (data Data, err error) {
+	defer recoverParseError(file, &err)
 
-	code := strings.TrimSpace(input)
-	data, _ := ParseAny(code, 0)
+	start := skipWhitespace(input, 0)
+	if start >= len(input) {
+		return nil, nil
+	}
 
-	if data == nil {
-		return nil, errors.New("Failed to parse string")
+	data, end := ParseAny(input, start)
+	if end = skipWhitespace(input, end); end < len(input) {
+		panic(NewParseError(input, end, "Unexpected input after expression"))
 	}
 
+	locate(data, lineOffsets(input), file)
 	return data, nil
 }
 
+// Parses all expressions of a module's source code and wraps them into (do ...)
+func ParseModule(input string, file string) (data Data, err error) {
+	defer recoverParseError(file, &err)
+
+	code := CreateList()
+	code.PushBack(Symbol{Value: "do"})
+
+	for offset := skipWhitespace(input, 0); offset < len(input); offset = skipWhitespace(input, offset) {
+		var item Data
+		item, offset = ParseAny(input, offset)
+		code.PushBack(item)
+	}
+
+	locate(code, lineOffsets(input), file)
+	return code, nil
+}
+
+// SourcePos is the position in the source code a list or symbol has been read from
+type SourcePos struct {
+	Module string
+	Line   int
+	Column int
+	offset int
+}
+
+func (pos *SourcePos) String() string {
+	module := pos.Module
+	if module == "" {
+		module = "<input>"
+	}
+
+	return fmt.Sprintf("%s:%d:%d", module, pos.Line, pos.Column)
+}
+
+// Returns the source position of a parsed list or symbol, or nil if unknown
+func PositionOf(code Data) *SourcePos {
+	switch t := code.(type) {
+	case List:
+		return t.pos
+	case Symbol:
+		return t.pos
+	}
+
+	return nil
+}
+
+// returns the offsets at which the lines of the input start
+func lineOffsets(input string) []int {
+	offsets := []int{0}
+	for i := 0; i < len(input); i++ {
+		if input[i] == '\n' {
+			offsets = append(offsets, i+1)
+		}
+	}
+	return offsets
+}
+
+// resolves line and column of the read offsets recorded in parsed code
+func locate(code Data, lines []int, module string) {
+	if pos := PositionOf(code); pos != nil {
+		line := sort.Search(len(lines), func(i int) bool { return lines[i] > pos.offset })
+		pos.Module = module
+		pos.Line = line
+		pos.Column = pos.offset - lines[line-1] + 1
+	}
+
+	if list, ok := code.(List); ok {
+		list.Foreach(func(item Data, i int) {
+			locate(item, lines, module)
+		})
+	}
+}
+
+// converts a raised parse error into a return value
+func recoverParseError(file string, err *error) {
+	if e := recover(); e != nil {
+		parseError, ok := e.(*ParseError)
+		if !ok {
+			panic(e)
+		}
+
+		parseError.File = file
+		*err = parseError
+	}
+}
+
 func ParseLambda(input string, offset int) (Data, int) {
 	if input[offset] != '#' {
-		panic("Invalid lambda start")
+		panic(NewParseError(input, offset, "Invalid lambda start"))
+	}
+
+	if offset+1 >= len(input) {
+		panic(NewParseError(input, offset, "Unexpected end of input"))
 	}
 
 	list, end := ParseList(input, offset+1)
-	list.(List).PushFront(Symbol{"lambda"})
+	list.(List).PushFront(Symbol{Value: "lambda"})
+	list.(List).pos.offset = offset
+	return list, end
+}
+
+// Parses the shorthands 'x, `x, ~x and ~@x for
+// (quote x), (quasiquote x), (unquote x) and (unquote-splicing x)
+func ParseQuote(input string, offset int) (Data, int) {
+	name, length := "quote", 1
+	switch {
+	case input[offset] == '`':
+		name = "quasiquote"
+	case strings.HasPrefix(input[offset:], "~@"):
+		name, length = "unquote-splicing", 2
+	case input[offset] == '~':
+		name = "unquote"
+	}
+
+	quoted, end := ParseAny(input, offset+length)
+	list := MakeList(Symbol{Value: name}, quoted)
+	list.pos = &SourcePos{offset: offset}
+
 	return list, end
 }
 
 func ParseList(input string, offset int) (Data, int) {
 	list := CreateList()
+	list.pos = &SourcePos{offset: offset}
 	start, end, readPos := getDelimeters(input, offset)
 
 	if start == '[' {
-		// [x1 x2 ... xn] denotes the datatype list (not to be executed)
-		list.PushBack(Symbol{"list"})
+		// [x1 x2 ... xn] denotes the datatype vector (not to be executed)
+		list.PushBack(Symbol{Value: "vector"})
 	} else if start == '{' {
 		// {} denotes dictionaries
-		list.PushBack(Symbol{"dict"})
+		list.PushBack(Symbol{Value: "dict"})
 	} else if start == '<' {
 		// <> anonymous function with implicit parameters (=lambda expr)
-		list.PushBack(Symbol{"lambda"})
+		list.PushBack(Symbol{Value: "lambda"})
 	}
 
-	for readPos < len(input)-1 && input[readPos] != end {
+	for readPos = skipWhitespace(input, readPos); readPos < len(input) && input[readPos] != end; readPos = skipWhitespace(input, readPos) {
 		item, endPos := ParseAny(input, readPos)
-
-		if item == nil {
-			return nil, readPos + 1
-		}
-
 		readPos = endPos
 		list.PushBack(item)
 	}
 
+	if readPos >= len(input) {
+		panic(NewParseError(input, offset, fmt.Sprintf("Missing closing '%c'", end)))
+	}
+
 	return list, readPos + 1
 }
 
+// Returns the items of a bracket literal [x1 x2 ...], which is read as (vector x1 x2 ...).
+// Parameter lists and let bindings are written this way.
+func LiteralItems(code List) List {
+	if symbol, ok := code.First().(Symbol); ok && (symbol.Value == "vector" || symbol.Value == "list") {
+		return code.SliceFrom(1)
+	}
+
+	return code
+}
+
 func ParseDict(input string, offset int) (Data, int) {
 	dict := CreateDict()
 	_, end, readPos := getDelimeters(input, offset)
 
-	for readPos < len(input)-1 && input[readPos] != end {
+	for readPos = skipWhitespace(input, readPos); readPos < len(input) && input[readPos] != end; readPos = skipWhitespace(input, readPos) {
 		if input[readPos] == ',' {
 			readPos++
 		}
 		key, keyEnd := ParseAny(input, readPos)
 		value, valueEnd := ParseAny(input, keyEnd)
 
-		dict.entries[key] = value
+		dict.Put(key, value)
 		readPos = valueEnd
 	}
 
+	if readPos >= len(input) {
+		panic(NewParseError(input, offset, fmt.Sprintf("Missing closing '%c'", end)))
+	}
+
 	return dict, readPos + 1
 }
 
@@ -98,7 +274,7 @@ func ParseString(input string, offset int) (Data, int) {
 	length := len(str)
 
 	if length == 0 {
-		panic(fmt.Sprintf("Failed to parse string in input \"%s\"", input[offset:]))
+		panic(NewParseError(input, offset, "Unterminated string"))
 	}
 
 	return String{str[1 : length-1]}, offset + length
@@ -109,11 +285,10 @@ func ParseSymbol(input string, offset int) (Data, int) {
 	length := len(str)
 
 	if length == 0 {
-		panic(fmt.Sprintf("Failed to parse symbol in input \"%s\" (char=%d)",
-			input[offset:], input[offset]))
+		panic(NewParseError(input, offset, fmt.Sprintf("Unexpected character '%c'", input[offset])))
 	}
 
-	return Symbol{str}, offset + length
+	return Symbol{Value: str, pos: &SourcePos{offset: offset}}, offset + length
 }
 
 func ParseKeyword(input string, offset int) (Data, int) {
@@ -121,11 +296,12 @@ func ParseKeyword(input string, offset int) (Data, int) {
 	length := len(str)
 
 	if length == 0 {
-		panic(fmt.Sprintf("Failed to parse keyword in input \"%s\"", input[offset:]))
+		panic(NewParseError(input, offset, "Invalid keyword"))
 	}
 
 	return Keyword{str}, offset + length
 }
+
 func ParseNumber(input string, offset int) (Data, int) {
 	// try float first
 	floatStr := floatRegex.FindString(input[offset:])
@@ -145,41 +321,27 @@ func ParseNumber(input string, offset int) (Data, int) {
 		}
 	}
 
-	panic(fmt.Sprintf("Invalid number format \"%s\"", input[offset:]))
+	panic(NewParseError(input, offset, "Invalid number format"))
 }
 
 // Parses any data value
 func ParseAny(input string, offset int) (Data, int) {
-	input_length := len(input)
-
-	// ignore whitespace
-	for input[offset] == ' ' || input[offset] == '\t' ||
-		input[offset] == '\r' || input[offset] == '\n' {
-		offset++
-
-		if input[offset] == ';' {
-			for input[offset] != '\n' && input[offset] != '\r' {
-				offset++
-				if offset >= input_length {
-					break
-				}
-			}
-		}
-
-		if offset >= input_length {
-			return Nothing{}, offset
-		}
+	offset = skipWhitespace(input, offset)
+	if offset >= len(input) {
+		panic(NewParseError(input, offset, "Unexpected end of input"))
 	}
 
 	switch input[offset] {
 	case '(', '[', '{':
 		return ParseList(input, offset)
-	case '"', '\'':
+	case '"':
 		return ParseString(input, offset)
+	case '\'', '`', '~':
+		return ParseQuote(input, offset)
 	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
 		return ParseNumber(input, offset)
 	case '-':
-		if input[offset+1] >= '0' && input[offset+1] <= '9' {
+		if offset+1 < len(input) && input[offset+1] >= '0' && input[offset+1] <= '9' {
 			return ParseNumber(input, offset)
 		} else {
 			return ParseSymbol(input, offset)
@@ -193,6 +355,24 @@ func ParseAny(input string, offset int) (Data, int) {
 	return ParseSymbol(input, offset)
 }
 
+// returns the offset of the next character that is neither whitespace nor part of a comment
+func skipWhitespace(input string, offset int) int {
+	for offset < len(input) {
+		switch input[offset] {
+		case ' ', '\t', '\r', '\n':
+			offset++
+		case ';':
+			for offset < len(input) && input[offset] != '\n' && input[offset] != '\r' {
+				offset++
+			}
+		default:
+			return offset
+		}
+	}
+
+	return offset
+}
+
 func getDelimeters(input string, offset int) (startDelim byte, endDelim byte, readPos int) {
 	startDelim = input[offset]
 
@@ -210,7 +390,7 @@ func getDelimeters(input string, offset int) (startDelim byte, endDelim byte, re
 	case '<':
 		endDelim = '>'
 	default:
-		panic("Unexpected start delimeter encountered: " + string(startDelim))
+		panic(NewParseError(input, offset, "Unexpected start delimeter encountered: "+string(startDelim)))
 	}
 
 	readPos = offset + 1
@@ -0,0 +1,805 @@
+package main
+
+//
+// This file contains the persistent collections. They are immutable, so every
+// modification returns a new version, which shares most of its structure with
+// the previous one. Vectors are bit-partitioned tries, maps and sets are hash
+// array mapped tries (HAMT).
+//
+
+import "bytes"
+import "fmt"
+
+const (
+	trieBits  = 5
+	trieWidth = 1 << trieBits
+	trieMask  = trieWidth - 1
+
+	// hash bits are consumed up to this shift, deeper nodes hold colliding keys in a list
+	hamtMaxShift = 30
+)
+
+//=============================================================================
+// Persistent vector
+//=============================================================================
+
+// node of a vector trie, inner nodes have children and leaves have items
+type trieNode struct {
+	children []*trieNode
+	items    []Data
+}
+
+type PersistentVector struct {
+	*pvector
+}
+
+type pvector struct {
+	count int
+	shift uint
+	root  *trieNode
+
+	// the last items are kept outside of the trie until a whole leaf is filled
+	tail []Data
+}
+
+var emptyPersistentVector = PersistentVector{&pvector{shift: trieBits, root: &trieNode{}}}
+
+func CreatePersistentVector() PersistentVector {
+	return emptyPersistentVector
+}
+
+func (v PersistentVector) Len() int {
+	return v.count
+}
+
+// index of the first item in the tail
+func (v PersistentVector) tailOffset() int {
+	if v.count < trieWidth {
+		return 0
+	}
+	return ((v.count - 1) >> trieBits) << trieBits
+}
+
+// Returns the item at index n (negative indices are offsets from the back) or Nothing
+func (v PersistentVector) Get(n int) Data {
+	if n < 0 {
+		n += v.count
+	}
+	if n < 0 || n >= v.count {
+		return Nothing{}
+	}
+
+	if n >= v.tailOffset() {
+		return v.tail[n-v.tailOffset()]
+	}
+
+	node := v.root
+	for level := v.shift; level > 0; level -= trieBits {
+		node = node.children[(n>>level)&trieMask]
+	}
+	return node.items[n&trieMask]
+}
+
+// Returns a new vector with the value appended
+func (v PersistentVector) Conj(value Data) PersistentVector {
+	// there is room left in the tail
+	if v.count-v.tailOffset() < trieWidth {
+		tail := make([]Data, len(v.tail), len(v.tail)+1)
+		copy(tail, v.tail)
+		return PersistentVector{&pvector{v.count + 1, v.shift, v.root, append(tail, value)}}
+	}
+
+	// otherwise the full tail becomes a leaf of the trie
+	leaf := &trieNode{items: v.tail}
+	root, shift := v.root, v.shift
+
+	if (v.count >> trieBits) > (1 << v.shift) {
+		// the trie is full, so it grows by one level
+		root = &trieNode{children: []*trieNode{v.root, newTriePath(v.shift, leaf)}}
+		shift += trieBits
+	} else {
+		root = v.pushLeaf(v.shift, v.root, leaf)
+	}
+
+	return PersistentVector{&pvector{v.count + 1, shift, root, []Data{value}}}
+}
+
+// copies the path to the rightmost leaf and appends the new leaf
+func (v PersistentVector) pushLeaf(level uint, parent *trieNode, leaf *trieNode) *trieNode {
+	index := ((v.count - 1) >> level) & trieMask
+	node := &trieNode{children: append([]*trieNode{}, parent.children...)}
+
+	var child *trieNode
+	if level == trieBits {
+		child = leaf
+	} else if index < len(parent.children) {
+		child = v.pushLeaf(level-trieBits, parent.children[index], leaf)
+	} else {
+		child = newTriePath(level-trieBits, leaf)
+	}
+
+	if index < len(node.children) {
+		node.children[index] = child
+	} else {
+		node.children = append(node.children, child)
+	}
+
+	return node
+}
+
+func newTriePath(level uint, leaf *trieNode) *trieNode {
+	if level == 0 {
+		return leaf
+	}
+
+	return &trieNode{children: []*trieNode{newTriePath(level-trieBits, leaf)}}
+}
+
+// Returns a new vector with the item at index n replaced. n may also be the length of the vector to append.
+func (v PersistentVector) Assoc(n int, value Data) PersistentVector {
+	if n < 0 {
+		n += v.count
+	}
+	if n == v.count {
+		return v.Conj(value)
+	}
+	if n < 0 || n > v.count {
+		panic(fmt.Sprintf("Index %d out of bounds", n))
+	}
+
+	if n >= v.tailOffset() {
+		tail := append([]Data{}, v.tail...)
+		tail[n-v.tailOffset()] = value
+		return PersistentVector{&pvector{v.count, v.shift, v.root, tail}}
+	}
+
+	return PersistentVector{&pvector{v.count, v.shift, assocTrie(v.root, v.shift, n, value), v.tail}}
+}
+
+// copies the path to the leaf containing item n and replaces it
+func assocTrie(node *trieNode, level uint, n int, value Data) *trieNode {
+	if level == 0 {
+		items := append([]Data{}, node.items...)
+		items[n&trieMask] = value
+		return &trieNode{items: items}
+	}
+
+	children := append([]*trieNode{}, node.children...)
+	index := (n >> level) & trieMask
+	children[index] = assocTrie(children[index], level-trieBits, n, value)
+	return &trieNode{children: children}
+}
+
+func (v PersistentVector) Foreach(f func(a Data, i int)) {
+	i := 0
+
+	var walk func(node *trieNode, level uint)
+	walk = func(node *trieNode, level uint) {
+		if level == 0 {
+			for _, item := range node.items {
+				f(item, i)
+				i++
+			}
+			return
+		}
+
+		for _, child := range node.children {
+			walk(child, level-trieBits)
+		}
+	}
+
+	walk(v.root, v.shift)
+	for _, item := range v.tail {
+		f(item, i)
+		i++
+	}
+}
+
+func (v PersistentVector) Items() []Data {
+	items := make([]Data, 0, v.count)
+	v.Foreach(func(item Data, i int) {
+		items = append(items, item)
+	})
+	return items
+}
+
+func (v PersistentVector) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	v.Foreach(func(item Data, i int) {
+		if i > 0 {
+			buffer.WriteString(" ")
+		}
+		buffer.WriteString(item.String())
+	})
+	buffer.WriteString("]")
+	return buffer.String()
+}
+
+// persistent vectors are equal to vectors and lists with equal contents
+func (v PersistentVector) Equals(other Data) bool {
+	var items []Data
+	switch t := other.(type) {
+	case PersistentVector, Vector, List:
+		items = sequenceItems(t)
+	default:
+		return false
+	}
+
+	if len(items) != v.count {
+		return false
+	}
+
+	equal := true
+	v.Foreach(func(item Data, i int) {
+		equal = equal && item.Equals(items[i])
+	})
+	return equal
+}
+
+func (v PersistentVector) GetType() DataType {
+	return PersistentVectorType
+}
+
+//=============================================================================
+// Hash array mapped trie
+//=============================================================================
+
+type hamtNode struct {
+	bitmap  uint32
+	entries []hamtEntry
+}
+
+// entry of a HAMT node, which is either a key with its value or a child node
+type hamtEntry struct {
+	key   Data
+	value Data
+	node  *hamtNode
+}
+
+// number of set bits, which is the position of an entry in the entries of a node
+func bitCount(x uint32) int {
+	count := 0
+	for ; x != 0; x &= x - 1 {
+		count++
+	}
+	return count
+}
+
+func (node *hamtNode) find(shift uint, hash uint32, key Data) (Data, bool) {
+	if shift > hamtMaxShift {
+		for _, entry := range node.entries {
+			if entry.key.Equals(key) {
+				return entry.value, true
+			}
+		}
+		return nil, false
+	}
+
+	bit := uint32(1) << ((hash >> shift) & trieMask)
+	if node.bitmap&bit == 0 {
+		return nil, false
+	}
+
+	entry := node.entries[bitCount(node.bitmap&(bit-1))]
+	if entry.node != nil {
+		return entry.node.find(shift+trieBits, hash, key)
+	}
+	if entry.key.Equals(key) {
+		return entry.value, true
+	}
+
+	return nil, false
+}
+
+// returns a new node with the key set to value and whether the key has been added
+func (node *hamtNode) assoc(shift uint, hash uint32, key Data, value Data) (*hamtNode, bool) {
+	if shift > hamtMaxShift {
+		for i, entry := range node.entries {
+			if entry.key.Equals(key) {
+				return node.replace(i, hamtEntry{key: key, value: value}), false
+			}
+		}
+		return node.insert(len(node.entries), 0, hamtEntry{key: key, value: value}), true
+	}
+
+	bit := uint32(1) << ((hash >> shift) & trieMask)
+	index := bitCount(node.bitmap & (bit - 1))
+
+	if node.bitmap&bit == 0 {
+		return node.insert(index, bit, hamtEntry{key: key, value: value}), true
+	}
+
+	entry := node.entries[index]
+	if entry.node != nil {
+		child, added := entry.node.assoc(shift+trieBits, hash, key, value)
+		return node.replace(index, hamtEntry{node: child}), added
+	}
+
+	if entry.key.Equals(key) {
+		return node.replace(index, hamtEntry{key: key, value: value}), false
+	}
+
+	// both keys share the hash bits consumed so far, so they move into a child node
+	child, _ := new(hamtNode).assoc(shift+trieBits, HashOf(entry.key), entry.key, entry.value)
+	child, _ = child.assoc(shift+trieBits, hash, key, value)
+	return node.replace(index, hamtEntry{node: child}), true
+}
+
+// returns a new node without the key and whether the key has been removed
+func (node *hamtNode) without(shift uint, hash uint32, key Data) (*hamtNode, bool) {
+	if shift > hamtMaxShift {
+		for i, entry := range node.entries {
+			if entry.key.Equals(key) {
+				return node.remove(i, 0), true
+			}
+		}
+		return node, false
+	}
+
+	bit := uint32(1) << ((hash >> shift) & trieMask)
+	if node.bitmap&bit == 0 {
+		return node, false
+	}
+
+	index := bitCount(node.bitmap & (bit - 1))
+	entry := node.entries[index]
+
+	if entry.node != nil {
+		child, removed := entry.node.without(shift+trieBits, hash, key)
+		if !removed {
+			return node, false
+		}
+		if len(child.entries) == 0 {
+			return node.remove(index, bit), true
+		}
+		return node.replace(index, hamtEntry{node: child}), true
+	}
+
+	if entry.key.Equals(key) {
+		return node.remove(index, bit), true
+	}
+
+	return node, false
+}
+
+func (node *hamtNode) replace(index int, entry hamtEntry) *hamtNode {
+	entries := append([]hamtEntry{}, node.entries...)
+	entries[index] = entry
+	return &hamtNode{node.bitmap, entries}
+}
+
+func (node *hamtNode) insert(index int, bit uint32, entry hamtEntry) *hamtNode {
+	entries := make([]hamtEntry, 0, len(node.entries)+1)
+	entries = append(entries, node.entries[:index]...)
+	entries = append(entries, entry)
+	entries = append(entries, node.entries[index:]...)
+	return &hamtNode{node.bitmap | bit, entries}
+}
+
+func (node *hamtNode) remove(index int, bit uint32) *hamtNode {
+	entries := make([]hamtEntry, 0, len(node.entries)-1)
+	entries = append(entries, node.entries[:index]...)
+	entries = append(entries, node.entries[index+1:]...)
+	return &hamtNode{node.bitmap &^ bit, entries}
+}
+
+func (node *hamtNode) foreach(f func(key Data, value Data)) {
+	for _, entry := range node.entries {
+		if entry.node != nil {
+			entry.node.foreach(f)
+		} else {
+			f(entry.key, entry.value)
+		}
+	}
+}
+
+//=============================================================================
+// Persistent map
+//=============================================================================
+
+type PersistentMap struct {
+	*pmap
+}
+
+type pmap struct {
+	count int
+	root  *hamtNode
+}
+
+var emptyPersistentMap = PersistentMap{&pmap{root: new(hamtNode)}}
+
+func CreatePersistentMap() PersistentMap {
+	return emptyPersistentMap
+}
+
+func (m PersistentMap) Len() int {
+	return m.count
+}
+
+func (m PersistentMap) Get(key Data) (Data, bool) {
+	return m.root.find(0, HashOf(key), key)
+}
+
+// Returns a new map with the key set to value
+func (m PersistentMap) Assoc(key Data, value Data) PersistentMap {
+	root, added := m.root.assoc(0, HashOf(key), key, value)
+	if added {
+		return PersistentMap{&pmap{m.count + 1, root}}
+	}
+	return PersistentMap{&pmap{m.count, root}}
+}
+
+// Returns a new map without the key
+func (m PersistentMap) Dissoc(key Data) PersistentMap {
+	root, removed := m.root.without(0, HashOf(key), key)
+	if !removed {
+		return m
+	}
+	return PersistentMap{&pmap{m.count - 1, root}}
+}
+
+func (m PersistentMap) Foreach(f func(key Data, value Data)) {
+	m.root.foreach(f)
+}
+
+func (m PersistentMap) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteString("{")
+	m.Foreach(func(key Data, value Data) {
+		if buffer.Len() > 1 {
+			buffer.WriteString(" ")
+		}
+		buffer.WriteString(key.String())
+		buffer.WriteString(" ")
+		buffer.WriteString(value.String())
+	})
+	buffer.WriteString("}")
+	return buffer.String()
+}
+
+// persistent maps are equal to maps and dictionaries with equal entries
+func (m PersistentMap) Equals(other Data) bool {
+	equal := true
+
+	switch t := other.(type) {
+	case PersistentMap:
+		if t.count != m.count {
+			return false
+		}
+		m.Foreach(func(key Data, value Data) {
+			otherValue, ok := t.Get(key)
+			equal = equal && ok && value.Equals(otherValue)
+		})
+	case Dict:
+		if t.Len() != m.count {
+			return false
+		}
+		t.Foreach(func(key Data, value Data) {
+			otherValue, ok := m.Get(key)
+			equal = equal && ok && value.Equals(otherValue)
+		})
+	default:
+		return false
+	}
+
+	return equal
+}
+
+func (m PersistentMap) GetType() DataType {
+	return PersistentMapType
+}
+
+//=============================================================================
+// Persistent set
+//=============================================================================
+
+type PersistentSet struct {
+	*pset
+}
+
+type pset struct {
+	count int
+	root  *hamtNode
+}
+
+var emptyPersistentSet = PersistentSet{&pset{root: new(hamtNode)}}
+
+func CreatePersistentSet() PersistentSet {
+	return emptyPersistentSet
+}
+
+func (s PersistentSet) Len() int {
+	return s.count
+}
+
+func (s PersistentSet) Contains(item Data) bool {
+	_, ok := s.root.find(0, HashOf(item), item)
+	return ok
+}
+
+// Returns a new set including the item
+func (s PersistentSet) Conj(item Data) PersistentSet {
+	root, added := s.root.assoc(0, HashOf(item), item, item)
+	if !added {
+		return s
+	}
+	return PersistentSet{&pset{s.count + 1, root}}
+}
+
+// Returns a new set without the item
+func (s PersistentSet) Disj(item Data) PersistentSet {
+	root, removed := s.root.without(0, HashOf(item), item)
+	if !removed {
+		return s
+	}
+	return PersistentSet{&pset{s.count - 1, root}}
+}
+
+func (s PersistentSet) Foreach(f func(item Data)) {
+	s.root.foreach(func(key Data, value Data) {
+		f(key)
+	})
+}
+
+func (s PersistentSet) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteString("#{")
+	s.Foreach(func(item Data) {
+		if buffer.Len() > 2 {
+			buffer.WriteString(" ")
+		}
+		buffer.WriteString(item.String())
+	})
+	buffer.WriteString("}")
+	return buffer.String()
+}
+
+func (s PersistentSet) Equals(other Data) bool {
+	otherSet, ok := other.(PersistentSet)
+	if !ok || otherSet.count != s.count {
+		return false
+	}
+
+	equal := true
+	s.Foreach(func(item Data) {
+		equal = equal && otherSet.Contains(item)
+	})
+	return equal
+}
+
+func (s PersistentSet) GetType() DataType {
+	return PersistentSetType
+}
+
+//=============================================================================
+// Native functions
+//=============================================================================
+
+// (persistent-vector x1 x2 ...)
+func _persistent_vector(args List, context *Context) Data {
+	vector := CreatePersistentVector()
+	args.Foreach(func(item Data, i int) {
+		vector = vector.Conj(item)
+	})
+	return vector
+}
+
+// (persistent-map key1 value1 key2 value2 ...)
+func _persistent_map(args List, context *Context) Data {
+	if args.Len()%2 == 1 {
+		panic("Persistent map requires an even number of arguments")
+	}
+
+	m := CreatePersistentMap()
+	for e := args.Front(); e != nil; e = e.Next().Next() {
+		m = m.Assoc(e.Value.(Data), e.Next().Value.(Data))
+	}
+	return m
+}
+
+// (persistent-set x1 x2 ...)
+func _persistent_set(args List, context *Context) Data {
+	set := CreatePersistentSet()
+	args.Foreach(func(item Data, i int) {
+		set = set.Conj(item)
+	})
+	return set
+}
+
+// (persistent x) - returns a persistent copy of x, converting nested lists, vectors and dictionaries
+func _persistent(args List, context *Context) Data {
+	args.RequireArity(1)
+	return toPersistent(args.First())
+}
+
+func toPersistent(data Data) Data {
+	switch t := data.(type) {
+	case List, Vector:
+		vector := CreatePersistentVector()
+		for _, item := range sequenceItems(t) {
+			vector = vector.Conj(toPersistent(item))
+		}
+		return vector
+	case Dict:
+		m := CreatePersistentMap()
+		t.Foreach(func(key Data, value Data) {
+			m = m.Assoc(key, toPersistent(value))
+		})
+		return m
+	}
+
+	return data
+}
+
+// (assoc coll key value ...) - returns a new map or vector with the keys set to the values
+func _assoc(args List, context *Context) Data {
+	args.RequireArity(3)
+	if args.Len()%2 == 0 {
+		panic("assoc expects a collection followed by pairs of keys and values")
+	}
+
+	coll := args.First()
+	for e := args.Front().Next(); e != nil; e = e.Next().Next() {
+		coll = assoc(coll, e.Value.(Data), e.Next().Value.(Data))
+	}
+	return coll
+}
+
+func assoc(coll Data, key Data, value Data) Data {
+	switch t := coll.(type) {
+	case PersistentMap:
+		return t.Assoc(key, value)
+	case PersistentVector:
+		index, ok := key.(Int)
+		if !ok {
+			panic(fmt.Sprintf("Vector index must be an Int, found %s", key.String()))
+		}
+		return t.Assoc(index.Value, value)
+	}
+
+	panic(fmt.Sprintf("%s is not a persistent map or vector", coll.String()))
+}
+
+// (dissoc coll key ...) - returns a new map or set without the keys
+func _dissoc(args List, context *Context) Data {
+	args.RequireArity(2)
+
+	coll := args.First()
+	args.Foreach(func(key Data, i int) {
+		if i == 0 {
+			return
+		}
+
+		switch t := coll.(type) {
+		case PersistentMap:
+			coll = t.Dissoc(key)
+		case PersistentSet:
+			coll = t.Disj(key)
+		default:
+			panic(fmt.Sprintf("%s is not a persistent map or set", coll.String()))
+		}
+	})
+	return coll
+}
+
+// (conj coll x ...) - returns a new vector or set with the items added.
+// Items added to maps are [key value] pairs.
+func _conj(args List, context *Context) Data {
+	args.RequireArity(2)
+
+	coll := args.First()
+	args.Foreach(func(item Data, i int) {
+		if i == 0 {
+			return
+		}
+
+		switch t := coll.(type) {
+		case PersistentVector:
+			coll = t.Conj(item)
+		case PersistentSet:
+			coll = t.Conj(item)
+		case PersistentMap:
+			pair := sequenceItems(item)
+			if len(pair) != 2 {
+				panic(fmt.Sprintf("Only [key value] pairs can be added to maps, found %s", item.String()))
+			}
+			coll = t.Assoc(pair[0], pair[1])
+		default:
+			panic(fmt.Sprintf("%s is not a persistent collection", coll.String()))
+		}
+	})
+	return coll
+}
+
+// (contains? coll key) - checks whether a map or dictionary has the key, a set the item
+// or a vector the index
+func _contains(args List, context *Context) Data {
+	ValidateArgs(args, []string{"Data", "Data"})
+
+	switch t := args.First().(type) {
+	case PersistentMap:
+		_, ok := t.Get(args.Second())
+		return Bool{ok}
+	case PersistentSet:
+		return Bool{t.Contains(args.Second())}
+	case Dict:
+		_, ok := t.Get(args.Second())
+		return Bool{ok}
+	case PersistentVector, Vector, List:
+		if index, ok := args.Second().(Int); ok {
+			return Bool{index.Value >= 0 && index.Value < len(sequenceItems(t))}
+		}
+		return Bool{false}
+	}
+
+	panic(fmt.Sprintf("%s is not a collection", args.First().String()))
+}
+
+// (get-in coll [key1 key2 ...]) - gets an entry of nested collections, Nothing if it doesn't exist
+func _get_in(args List, context *Context) Data {
+	ValidateArgs(args, []string{"Data", "Data"})
+
+	coll := args.First()
+	for _, key := range sequenceItems(args.Second()) {
+		coll = getEntry(coll, key)
+	}
+	return coll
+}
+
+// (update-in coll [key1 key2 ...] f args...) - returns a new version of nested persistent
+// collections, in which the entry is replaced by (f entry args...). Missing maps are created.
+func _update_in(args List, context *Context) Data {
+	args.RequireArity(3)
+
+	f, ok := args.Third().(Caller)
+	if !ok {
+		panic(fmt.Sprintf("%s is not a function", args.Third().String()))
+	}
+
+	return updateIn(args.First(), sequenceItems(args.Second()), f, sequenceItems(args.SliceFrom(3)), context)
+}
+
+func updateIn(coll Data, keys []Data, f Caller, args []Data, context *Context) Data {
+	if len(keys) == 0 {
+		return CallWithValues(f, MakeList(append([]Data{coll}, args...)...), context)
+	}
+
+	if _, ok := coll.(Nothing); ok {
+		coll = CreatePersistentMap()
+	}
+
+	return assoc(coll, keys[0], updateIn(getEntry(coll, keys[0]), keys[1:], f, args, context))
+}
+
+// returns the entry of any collection or Nothing
+func getEntry(coll Data, key Data) Data {
+	switch t := coll.(type) {
+	case PersistentMap:
+		if value, ok := t.Get(key); ok {
+			return value
+		}
+	case PersistentSet:
+		if t.Contains(key) {
+			return key
+		}
+	case Dict:
+		if value, ok := t.Get(key); ok {
+			return value
+		}
+	case PersistentVector:
+		if index, ok := key.(Int); ok {
+			return t.Get(index.Value)
+		}
+	case Vector:
+		if index, ok := key.(Int); ok {
+			return t.Get(index.Value)
+		}
+	case List:
+		if index, ok := key.(Int); ok {
+			return t.Get(index.Value)
+		}
+	}
+
+	return Nothing{}
+}
@@ -0,0 +1,291 @@
+package main
+
+//
+// This file contains the recording of events into a file and their replay
+//
+// Each event is written on a line of its own as gamelisp data, e.g.
+//   {:frame 12 :source 3 :event Move :args {:dir "forward"}}
+// Entities are written as (entity id), lists as (list ...) and symbols as (quote name).
+// Backslashes, quotes and line breaks in strings are escaped.
+//
+
+import "bufio"
+import "bytes"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "strconv"
+import "strings"
+import "sync"
+import "mk/Apollo/events"
+
+// files the events of the game are recorded into and replayed from, set by command line flags
+var RecordEventsPath = ""
+var ReplayEventsPath = ""
+
+// Writes the events passing through an event bus into a file
+type EventRecording struct {
+	file   *os.File
+	writer *bufio.Writer
+	frame  int
+	mutex  sync.Mutex
+}
+
+func NewEventRecording(path string) (*EventRecording, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	recording := new(EventRecording)
+	recording.file = file
+	recording.writer = bufio.NewWriter(file)
+	return recording, nil
+}
+
+// Sets the number of the frame that following events are recorded for
+func (r *EventRecording) SetFrame(frame int) {
+	r.mutex.Lock()
+	r.frame = frame
+	r.mutex.Unlock()
+}
+
+func (r *EventRecording) Record(event events.EventMessage) {
+	userEvent, ok := event.Content.(*UserEvent)
+	if !ok {
+		return
+	}
+
+	source := uint64(0)
+	if event.Source != nil {
+		source = event.Source.EventSourceID()
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	fmt.Fprintf(r.writer, "{:frame %d :source %d :event %s :args %s}\n", r.frame, source,
+		userEvent.Definition.Name, recordedLiteral(userEvent.Arguments))
+}
+
+// Writes the remaining events and closes the file
+func (r *EventRecording) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.writer.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// The parser ends strings at any quote, so quotes are written as \x22
+var recordedStringEscapes = strings.NewReplacer(`\`, `\\`, `"`, `\x22`, "\n", `\n`, "\r", `\r`)
+
+// returns the literal of data that is read back by recordedValue
+func recordedLiteral(data Data) string {
+	var buffer bytes.Buffer
+
+	switch t := data.(type) {
+	case String:
+		return `"` + recordedStringEscapes.Replace(t.Value) + `"`
+	case *Entity:
+		return fmt.Sprintf("(entity %d)", t.id)
+	case Symbol:
+		return "(quote " + t.Value + ")"
+	case Float:
+		// floats must be read back as floats, even if they have no fractional part
+		str := strconv.FormatFloat(t.Value, 'f', -1, 64)
+		if !strings.Contains(str, ".") {
+			str += ".0"
+		}
+		return str
+	case List:
+		buffer.WriteString("(list")
+		t.Foreach(func(item Data, i int) {
+			buffer.WriteString(" " + recordedLiteral(item))
+		})
+		buffer.WriteString(")")
+	case Vector:
+		buffer.WriteString("[")
+		for i, item := range t.Items() {
+			if i > 0 {
+				buffer.WriteString(" ")
+			}
+			buffer.WriteString(recordedLiteral(item))
+		}
+		buffer.WriteString("]")
+	case Dict:
+		buffer.WriteString("{")
+		t.Foreach(func(key Data, value Data) {
+			if buffer.Len() > 1 {
+				buffer.WriteString(" ")
+			}
+			buffer.WriteString(recordedLiteral(key) + " " + recordedLiteral(value))
+		})
+		buffer.WriteString("}")
+	default:
+		return data.String()
+	}
+
+	return buffer.String()
+}
+
+// converts the parsed literal back into the recorded data
+func recordedValue(data Data) Data {
+	switch t := data.(type) {
+	case List:
+		items := make([]Data, 0, t.Len())
+		t.SliceFrom(1).Foreach(func(item Data, i int) {
+			items = append(items, recordedValue(item))
+		})
+
+		tag, _ := t.First().(Symbol)
+		switch tag.Value {
+		case "entity":
+			return &Entity{id: uint64(items[0].(Int).Value)}
+		case "quote":
+			return t.Second()
+		case "vector":
+			return MakeVector(items...)
+		case "dict":
+			dict := CreateDict()
+			for i := 0; i+1 < len(items); i += 2 {
+				dict.Put(items[i], items[i+1])
+			}
+			return dict
+		default:
+			list := MakeList(items...)
+			list.evaluated = true
+			return list
+		}
+	case String:
+		if value, err := strconv.Unquote(`"` + t.Value + `"`); err == nil {
+			return String{value}
+		}
+	case Symbol:
+		// symbols other than these constants have been recorded as (quote name)
+		switch t.Value {
+		case "true":
+			return Bool{true}
+		case "false":
+			return Bool{false}
+		case "Nothing":
+			return Nothing{}
+		}
+	}
+
+	return data
+}
+
+//-----------------------------------------------------------------------------
+// Replay
+
+type RecordedEvent struct {
+	Frame     int
+	Source    uint64
+	Event     string
+	Arguments Dict
+}
+
+// Reads the events of a recording in the order they have been recorded
+func ReadEventRecording(path string) ([]RecordedEvent, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ParseModule(string(content), path)
+	if err != nil {
+		return nil, err
+	}
+
+	recorded := make([]RecordedEvent, 0)
+	for e := data.(List).Front().Next(); e != nil; e = e.Next() {
+		item := e.Value.(Data)
+		record, ok := recordedValue(item).(Dict)
+		if !ok {
+			return nil, fmt.Errorf("%s: invalid event record %s", path, item.String())
+		}
+
+		frame, ok1 := record.GetOrDefault(Keyword{":frame"}, nil).(Int)
+		source, ok2 := record.GetOrDefault(Keyword{":source"}, nil).(Int)
+		name, ok3 := record.GetOrDefault(Keyword{":event"}, nil).(Symbol)
+		args, ok4 := record.GetOrDefault(Keyword{":args"}, CreateDict()).(Dict)
+		if !ok1 || !ok2 || !ok3 || !ok4 {
+			return nil, fmt.Errorf("%s: invalid event record %s", path, item.String())
+		}
+
+		recorded = append(recorded, RecordedEvent{frame.Value, uint64(source.Value), name.Value, args})
+	}
+
+	return recorded, nil
+}
+
+// Replays recorded events into an event bus frame by frame
+type EventReplay struct {
+	events  []RecordedEvent
+	next    int
+	bus     *events.EventBus
+	context *Context
+}
+
+// Starts replaying the events. Events triggered by the running scripts are dropped from
+// now on, as the recording already contains them.
+func NewEventReplay(recorded []RecordedEvent, bus *events.EventBus, context *Context) *EventReplay {
+	bus.SetReplaying(true)
+	return &EventReplay{events: recorded, bus: bus, context: context}
+}
+
+// Triggers the events recorded for all frames up to the given one
+func (r *EventReplay) Replay(frame int) error {
+	for ; r.next < len(r.events) && r.events[r.next].Frame <= frame; r.next++ {
+		recorded := r.events[r.next]
+
+		def, ok := r.context.LookUp(Symbol{Value: recorded.Event}).(*UserEventDefinition)
+		if !ok {
+			return fmt.Errorf("Cannot replay undefined event %s", recorded.Event)
+		}
+
+		var source events.EventSource
+		if recorded.Source != 0 {
+			source = &Entity{id: recorded.Source}
+		}
+
+		r.bus.Inject(&UserEvent{def, recorded.Arguments}, source)
+	}
+
+	return nil
+}
+
+// Returns true once all events have been replayed
+func (r *EventReplay) Done() bool {
+	return r.next >= len(r.events)
+}
+
+// Starts recording and replaying events as requested by the command line flags.
+// Either result is nil if not requested.
+func startRecordingAndReplay(bus *events.EventBus, context *Context) (*EventRecording, *EventReplay, error) {
+	var recording *EventRecording
+	var replay *EventReplay
+
+	if ReplayEventsPath != "" {
+		recorded, err := ReadEventRecording(ReplayEventsPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		replay = NewEventReplay(recorded, bus, context)
+	}
+
+	if RecordEventsPath != "" {
+		r, err := NewEventRecording(RecordEventsPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		recording = r
+		bus.SetRecorder(recording)
+	}
+
+	return recording, replay, nil
+}
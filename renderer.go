@@ -0,0 +1,161 @@
+package main
+
+//
+// This file contains the renderer interface the world and scripts draw with
+//
+
+import "math"
+
+type Color struct {
+	R, G, B, A float64
+}
+
+// A flat coloured quad, its vertices are given in order around the quad
+type Quad struct {
+	Vertices [4]Vertex3D
+	Color    Color
+}
+
+type Mesh struct {
+	Quads []Quad
+}
+
+type Camera struct {
+	Position Vertex3D
+	Target   Vertex3D
+	Up       Vertex3D
+
+	// vertical field of view in degrees
+	FieldOfView float64
+	Near, Far   float64
+
+	// an orthographic camera shows what a perspective one shows at the distance of its target
+	Orthographic bool
+}
+
+func DefaultCamera() Camera {
+	return Camera{
+		Position:    Vertex3D{0, 1.5, 5},
+		Target:      Vertex3D{0, 0, 0},
+		Up:          Vertex3D{0, 1, 0},
+		FieldOfView: 45,
+		Near:        0.1,
+		Far:         100,
+	}
+}
+
+// Draws the frames of the game. Frames are drawn between BeginFrame and EndFrame.
+type Renderer interface {
+	// Sets the colour the following frames are cleared with
+	SetClearColor(color Color)
+
+	Camera() Camera
+	SetCamera(camera Camera)
+
+	// Clears the frame and sets up the camera
+	BeginFrame()
+	DrawQuad(quad Quad)
+	DrawMesh(mesh *Mesh)
+	EndFrame()
+}
+
+//-----------------------------------------------------------------------------
+// Matrices
+
+// 4x4 matrix in row-major order
+type matrix4 [16]float64
+
+func (m matrix4) Multiply(other matrix4) matrix4 {
+	var result matrix4
+	for row := 0; row < 4; row++ {
+		for col := 0; col < 4; col++ {
+			sum := 0.0
+			for i := 0; i < 4; i++ {
+				sum += m[row*4+i] * other[i*4+col]
+			}
+			result[row*4+col] = sum
+		}
+	}
+	return result
+}
+
+// Returns the homogeneous coordinates (x, y, z, w) of the transformed point
+func (m matrix4) Transform(v Vertex3D) Vertex4D {
+	return Vertex4D{
+		Vertex3D{
+			m[0]*v.X + m[1]*v.Y + m[2]*v.Z + m[3],
+			m[4]*v.X + m[5]*v.Y + m[6]*v.Z + m[7],
+			m[8]*v.X + m[9]*v.Y + m[10]*v.Z + m[11],
+		},
+		m[12]*v.X + m[13]*v.Y + m[14]*v.Z + m[15],
+	}
+}
+
+// Same as gluLookAt. A camera looking along its up axis, e.g. straight down, turns its up axis
+// towards the world axis most perpendicular to the view direction.
+func (camera Camera) ViewMatrix() matrix4 {
+	f := camera.Target.Sub(camera.Position).Normalize()
+	if f.Length() == 0 {
+		// without direction the camera looks along the negative z axis like OpenGL's default
+		f = Vertex3D{0, 0, -1}
+	}
+
+	s := f.Cross(camera.Up)
+	if s.Length() <= 1e-9*camera.Up.Length() {
+		s = f.Cross(perpendicularAxis(f))
+	}
+	s = s.Normalize()
+	u := s.Cross(f)
+	eye := camera.Position
+
+	return matrix4{
+		s.X, s.Y, s.Z, -s.Dot(eye),
+		u.X, u.Y, u.Z, -u.Dot(eye),
+		-f.X, -f.Y, -f.Z, f.Dot(eye),
+		0, 0, 0, 1,
+	}
+}
+
+// Returns the world axis that is the least parallel to the direction, preferring the y axis
+// and then the negative z axis, e.g. to look straight down with the negative z axis up
+func perpendicularAxis(direction Vertex3D) Vertex3D {
+	axes := []Vertex3D{{0, 1, 0}, {0, 0, -1}, {1, 0, 0}}
+	direction = direction.Normalize()
+
+	axis := axes[0]
+	for _, other := range axes[1:] {
+		if math.Abs(direction.Dot(other)) < math.Abs(direction.Dot(axis)) {
+			axis = other
+		}
+	}
+	return axis
+}
+
+// Same as gluPerspective or glOrtho for the given aspect ratio (width / height)
+func (camera Camera) ProjectionMatrix(aspect float64) matrix4 {
+	near, far := camera.Near, camera.Far
+
+	if camera.Orthographic {
+		right, top := camera.orthographicExtents(aspect)
+		return matrix4{
+			1 / right, 0, 0, 0,
+			0, 1 / top, 0, 0,
+			0, 0, -2 / (far - near), -(far + near) / (far - near),
+			0, 0, 0, 1,
+		}
+	}
+
+	tangent := math.Tan(camera.FieldOfView * math.Pi / 360)
+	return matrix4{
+		1 / (tangent * aspect), 0, 0, 0,
+		0, 1 / tangent, 0, 0,
+		0, 0, (far + near) / (near - far), 2 * far * near / (near - far),
+		0, 0, -1, 0,
+	}
+}
+
+// the extents of an orthographic camera, see ProjectionMatrix
+func (camera Camera) orthographicExtents(aspect float64) (right float64, top float64) {
+	top = math.Tan(camera.FieldOfView*math.Pi/360) * camera.Target.Sub(camera.Position).Length()
+	return top * aspect, top
+}
@@ -0,0 +1,75 @@
+package main
+
+import glu "github.com/go-gl/glu"
+import gl "github.com/go-gl/gl"
+
+// Renders with immediate mode OpenGL into the current context
+type GLRenderer struct {
+	Width, Height int
+
+	camera Camera
+}
+
+func NewGLRenderer(width, height int) *GLRenderer {
+	gl.Enable(gl.DEPTH_TEST)
+	return &GLRenderer{Width: width, Height: height, camera: DefaultCamera()}
+}
+
+func (r *GLRenderer) SetClearColor(color Color) {
+	gl.ClearColor(gl.GLclampf(color.R), gl.GLclampf(color.G), gl.GLclampf(color.B), gl.GLclampf(color.A))
+}
+
+func (r *GLRenderer) Camera() Camera {
+	return r.camera
+}
+
+func (r *GLRenderer) SetCamera(camera Camera) {
+	r.camera = camera
+}
+
+func (r *GLRenderer) BeginFrame() {
+	gl.Viewport(0, 0, r.Width, r.Height)
+	gl.Clear(gl.COLOR_BUFFER_BIT | gl.DEPTH_BUFFER_BIT)
+
+	camera := r.camera
+	aspect := float64(r.Width) / float64(r.Height)
+
+	gl.MatrixMode(gl.PROJECTION)
+	gl.LoadIdentity()
+	if camera.Orthographic {
+		right, top := camera.orthographicExtents(aspect)
+		gl.Ortho(-right, right, -top, top, camera.Near, camera.Far)
+	} else {
+		glu.Perspective(camera.FieldOfView, aspect, camera.Near, camera.Far)
+	}
+
+	gl.MatrixMode(gl.MODELVIEW)
+	gl.LoadIdentity()
+	glu.LookAt(camera.Position.X, camera.Position.Y, camera.Position.Z,
+		camera.Target.X, camera.Target.Y, camera.Target.Z,
+		camera.Up.X, camera.Up.Y, camera.Up.Z)
+}
+
+func (r *GLRenderer) DrawQuad(quad Quad) {
+	gl.Begin(gl.QUADS)
+	r.vertices(quad)
+	gl.End()
+}
+
+func (r *GLRenderer) DrawMesh(mesh *Mesh) {
+	gl.Begin(gl.QUADS)
+	for _, quad := range mesh.Quads {
+		r.vertices(quad)
+	}
+	gl.End()
+}
+
+func (r *GLRenderer) vertices(quad Quad) {
+	gl.Color3d(quad.Color.R, quad.Color.G, quad.Color.B)
+	for _, v := range quad.Vertices {
+		gl.Vertex3d(v.X, v.Y, v.Z)
+	}
+}
+
+func (r *GLRenderer) EndFrame() {
+}
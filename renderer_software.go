@@ -0,0 +1,181 @@
+package main
+
+//
+// This file contains a renderer that rasterizes frames in memory, e.g. to write them into
+// PNG files on machines without graphics card
+//
+
+import "image"
+import "image/color"
+import "image/png"
+import "math"
+import "os"
+
+type SoftwareRenderer struct {
+	Width, Height int
+
+	camera     Camera
+	clearColor Color
+
+	// transforms world coordinates into clip coordinates, set up by BeginFrame
+	transform matrix4
+
+	image *image.RGBA
+
+	// depth of the pixels in normalized device coordinates (-1 near to 1 far)
+	depth []float64
+}
+
+func NewSoftwareRenderer(width, height int) *SoftwareRenderer {
+	r := new(SoftwareRenderer)
+	r.Width = width
+	r.Height = height
+	r.camera = DefaultCamera()
+	r.clearColor = Color{0, 0, 0, 1}
+	r.image = image.NewRGBA(image.Rect(0, 0, width, height))
+	r.depth = make([]float64, width*height)
+	return r
+}
+
+func (r *SoftwareRenderer) SetClearColor(color Color) {
+	r.clearColor = color
+}
+
+func (r *SoftwareRenderer) Camera() Camera {
+	return r.camera
+}
+
+func (r *SoftwareRenderer) SetCamera(camera Camera) {
+	r.camera = camera
+}
+
+func (r *SoftwareRenderer) BeginFrame() {
+	background := toRGBA(r.clearColor)
+	for y := 0; y < r.Height; y++ {
+		for x := 0; x < r.Width; x++ {
+			r.image.SetRGBA(x, y, background)
+		}
+	}
+	for i := range r.depth {
+		r.depth[i] = math.Inf(1)
+	}
+
+	aspect := float64(r.Width) / float64(r.Height)
+	r.transform = r.camera.ProjectionMatrix(aspect).Multiply(r.camera.ViewMatrix())
+}
+
+// Quads are drawn as two triangles. Triangles reaching behind the near plane are skipped, as
+// are those that a degenerate camera projects to infinite or undefined coordinates.
+func (r *SoftwareRenderer) DrawQuad(quad Quad) {
+	var points [4]Vertex3D
+	for i, v := range quad.Vertices {
+		clip := r.transform.Transform(v)
+		if !r.camera.Orthographic && clip.W < r.camera.Near {
+			return
+		}
+
+		// normalized device coordinates to pixels, the y axis points down in the image
+		points[i] = Vertex3D{
+			(clip.X/clip.W + 1) / 2 * float64(r.Width),
+			(1 - clip.Y/clip.W) / 2 * float64(r.Height),
+			clip.Z / clip.W,
+		}
+		if !finite(points[i]) {
+			return
+		}
+	}
+
+	color := toRGBA(quad.Color)
+	r.fillTriangle(points[0], points[1], points[2], color)
+	r.fillTriangle(points[0], points[2], points[3], color)
+}
+
+func (r *SoftwareRenderer) DrawMesh(mesh *Mesh) {
+	for _, quad := range mesh.Quads {
+		r.DrawQuad(quad)
+	}
+}
+
+func (r *SoftwareRenderer) EndFrame() {
+}
+
+// Fills the pixels whose centres lie within the triangle and in front of what has been drawn
+func (r *SoftwareRenderer) fillTriangle(a, b, c Vertex3D, fill color.RGBA) {
+	area := edge(a, b, c)
+	if area == 0 {
+		return
+	}
+
+	// the bounds are clipped to the image before they are converted, which overflows for
+	// coordinates far outside of it
+	minX := math.Max(0, math.Floor(math.Min(a.X, math.Min(b.X, c.X))))
+	maxX := math.Min(float64(r.Width-1), math.Ceil(math.Max(a.X, math.Max(b.X, c.X))))
+	minY := math.Max(0, math.Floor(math.Min(a.Y, math.Min(b.Y, c.Y))))
+	maxY := math.Min(float64(r.Height-1), math.Ceil(math.Max(a.Y, math.Max(b.Y, c.Y))))
+	if minX > maxX || minY > maxY {
+		return
+	}
+
+	for y := int(minY); y <= int(maxY); y++ {
+		for x := int(minX); x <= int(maxX); x++ {
+			p := Vertex3D{float64(x) + 0.5, float64(y) + 0.5, 0}
+
+			// barycentric coordinates, which are all positive inside the triangle regardless of its winding
+			wa := edge(b, c, p) / area
+			wb := edge(c, a, p) / area
+			wc := edge(a, b, p) / area
+			if wa < 0 || wb < 0 || wc < 0 {
+				continue
+			}
+
+			depth := wa*a.Z + wb*b.Z + wc*c.Z
+			i := y*r.Width + x
+			if depth < -1 || depth > 1 || depth >= r.depth[i] {
+				continue
+			}
+
+			r.depth[i] = depth
+			r.image.SetRGBA(x, y, fill)
+		}
+	}
+}
+
+func finite(v Vertex3D) bool {
+	for _, coordinate := range []float64{v.X, v.Y, v.Z} {
+		if math.IsNaN(coordinate) || math.IsInf(coordinate, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// twice the signed area of the triangle a, b, p in the image plane
+func edge(a, b, p Vertex3D) float64 {
+	return (b.X-a.X)*(p.Y-a.Y) - (b.Y-a.Y)*(p.X-a.X)
+}
+
+func toRGBA(c Color) color.RGBA {
+	channel := func(value float64) uint8 {
+		return uint8(math.Max(0, math.Min(1, value))*255 + 0.5)
+	}
+	return color.RGBA{channel(c.R), channel(c.G), channel(c.B), channel(c.A)}
+}
+
+// Returns the last frame
+func (r *SoftwareRenderer) Image() *image.RGBA {
+	return r.image
+}
+
+// Writes the last frame into a PNG file
+func (r *SoftwareRenderer) SavePNG(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := png.Encode(file, r.image); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -1,5 +1,6 @@
 package main
 
+import "bytes"
 import "errors"
 import "fmt"
 import "io/ioutil"
@@ -13,6 +14,9 @@ import gopath "path/filepath"
 
 var MainContext *Context
 
+// if set, events are dispatched once per frame on the main goroutine instead of concurrently
+var SynchronousEvents = false
+
 // modules by name
 var modules map[string]*Module = make(map[string]*Module)
 
@@ -26,6 +30,10 @@ type Context struct {
 	symbols map[string]Data
 	parent  *Context
 	usages  []Usage
+
+	// compiled code addresses parameters and let bindings by slot
+	slots     []Data
+	slotNames []string
 }
 
 type Usage struct {
@@ -40,7 +48,11 @@ type Module struct {
 }
 
 func (module *Module) Refresh() {
-	module.Reload()
+	if err := module.Reload(); err != nil {
+		// keep the previous definitions running if the new version is broken
+		fmt.Println(err.Error())
+		return
+	}
 
 	// reimport this module into all usage contexts
 	for _, usage := range module.context.usages {
@@ -61,19 +73,23 @@ func (c *Context) GetType() DataType {
 }
 
 func (c *Context) GetEventBus() *events.EventBus {
-	eventBus := c.LookUp(Symbol{"$events"}).(NativeObject).Value.(*events.EventBus)
+	eventBus := c.LookUp(Symbol{Value: "$events"}).(NativeObject).Value.(*events.EventBus)
 	return eventBus
 }
 
 // Gets a module by name. Loads the module beforehand if necessary
-func GetModule(name string, env *Context) *Module {
+func GetModule(name string, env *Context) (*Module, error) {
 	module, ok := modules[name]
 	if !ok {
-		module = LoadModule(name, env)
+		var err error
+		module, err = LoadModule(name, env)
+		if err != nil {
+			return nil, err
+		}
 		modules[name] = module
 	}
 
-	return module
+	return module, nil
 }
 
 func FindModuleFile(name string) string {
@@ -95,82 +111,113 @@ func FindModuleFile(name string) string {
 	return ""
 }
 
-func (module *Module) Reload() {
+func (module *Module) Reload() error {
 	bytes, err := ioutil.ReadFile(module.source)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to reload module %s: %s", module.name, err.Error()))
+		return errors.New(fmt.Sprintf("Failed to reload module %s: %s", module.name, err.Error()))
 	}
 
-	text := "(do " + string(bytes) + ""
-	_, err = EvaluateString(text, module.context)
+	code, err := ParseModule(string(bytes), module.source)
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
+
+	_, err = Evaluate(code, module.context)
+	return err
 }
 
-func LoadModule(name string, env *Context) *Module {
+func LoadModule(name string, env *Context) (*Module, error) {
 	path := FindModuleFile(name)
 	if path == "" {
-		panic(fmt.Sprintf("Module %s could not be found in search path", name))
+		return nil, errors.New(fmt.Sprintf("Module %s could not be found in search path", name))
 	}
 	bytes, err := ioutil.ReadFile(path)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to load module %s: %s", name, err.Error()))
+		return nil, errors.New(fmt.Sprintf("Failed to load module %s: %s", name, err.Error()))
+	}
+
+	code, err := ParseModule(string(bytes), path)
+	if err != nil {
+		return nil, err
 	}
 
-	text := "(do " + string(bytes) + ""
 	context := NewContext()
 	context.parent = env
 
-	_, err = EvaluateString(text, context)
-	if err == nil {
-		module := new(Module)
-		module.name = name
-		module.context = context
-		module.source = path
-
-		err := watcher.Watch(filepath.Dir(path))
-		if err != nil {
-			fmt.Print(err.Error())
-		}
+	_, err = Evaluate(code, context)
+	if err != nil {
+		return nil, err
+	}
 
-		modulesByPath[path] = module
+	module := new(Module)
+	module.name = name
+	module.context = context
+	module.source = path
 
-		return module
-	} else {
-		panic(err.Error())
+	err = watcher.Watch(filepath.Dir(path))
+	if err != nil {
+		fmt.Print(err.Error())
 	}
+
+	modulesByPath[path] = module
+
+	return module, nil
 }
 
 func NewContext() *Context {
 	return &Context{
-		make(map[string]Data),
-		nil,
-		make([]Usage, 0),
+		symbols: make(map[string]Data),
+		usages:  make([]Usage, 0),
 	}
 }
 
+// Creates a context whose symbols are stored in slots, as used by compiled code
+func NewSlotContext(parent *Context, names []string, slots []Data) *Context {
+	return &Context{
+		parent:    parent,
+		slots:     slots,
+		slotNames: names,
+	}
+}
+
+// returns the index of the slot for the given name or -1.
+// If a name occurs multiple times the last slot counts.
+func (c *Context) slotIndex(name string) int {
+	for i := len(c.slotNames) - 1; i >= 0; i-- {
+		if c.slotNames[i] == name {
+			return i
+		}
+	}
+	return -1
+}
+
 func (c *Context) Define(symbol Symbol, value Data) {
+	if i := c.slotIndex(symbol.Value); i >= 0 {
+		c.slots[i] = value
+		return
+	}
+
+	if c.symbols == nil {
+		c.symbols = make(map[string]Data)
+	}
 	c.symbols[symbol.Value] = value
 }
 
 func (c *Context) IsDefined(symbol Symbol) bool {
-	_, defined := c.symbols[symbol.Value]
-	if !defined && c.parent != nil {
-		return c.parent.IsDefined(symbol)
-	}
-	return defined
+	return c.LookUp(symbol) != nil
 }
 
 func (c *Context) LookUp(symbol Symbol) Data {
-	val, defined := c.symbols[symbol.Value]
-	if defined {
-		return val
-	} else if c.parent != nil {
-		return c.parent.LookUp(symbol)
-	} else {
-		return nil
+	for context := c; context != nil; context = context.parent {
+		if val, defined := context.symbols[symbol.Value]; defined {
+			return val
+		}
+		if i := context.slotIndex(symbol.Value); i >= 0 {
+			return context.slots[i]
+		}
 	}
+
+	return nil
 }
 
 func (c *Context) Reimport(other *Context, prefix string) {
@@ -179,7 +226,7 @@ func (c *Context) Reimport(other *Context, prefix string) {
 			if current, ok := c.symbols[prefix+key]; ok {
 				if currentFunction, ok := current.(*Function); ok && currentFunction.Name == newFunction.Name {
 					// replace function definition in place
-					currentFunction.Dispatchers = newFunction.Dispatchers
+					currentFunction.SetDispatchers(newFunction.Dispatchers)
 				}
 
 			}
@@ -211,64 +258,142 @@ func EvaluateString(code string, context *Context) (Data, error) {
 	return result, nil
 }
 
-func Evaluate(code Data, context *Context) (Data, error) {
+// RuntimeError is raised when the evaluation of gamelisp code fails. Besides the
+// position of the failing expression it contains a stack trace of function calls.
+// In gamelisp it's the data type Error, which can be thrown and caught by scripts.
+type RuntimeError struct {
+	Message string
+	Data    Dict
+	Pos     *SourcePos
+	Stack   []StackFrame
+
+	// position in the innermost frame that has not been added to the stack yet
+	location *SourcePos
+}
+
+// A function call in the stack trace of a runtime error
+type StackFrame struct {
+	Function string
+	Dispatch string
+	Pos      *SourcePos
+}
+
+func (frame StackFrame) String() string {
+	str := frame.Function + " " + frame.Dispatch
+	if frame.Pos != nil {
+		str += " at " + frame.Pos.String()
+	}
+	return str
+}
+
+func (e *RuntimeError) Error() string {
+	var buffer bytes.Buffer
+	buffer.WriteString(e.Message)
+
+	for _, frame := range e.Stack {
+		buffer.WriteString("\n\tin " + frame.String())
+	}
+
+	if e.location != nil {
+		buffer.WriteString("\n\tat " + e.location.String())
+	}
+
+	return buffer.String()
+}
+
+func (e *RuntimeError) String() string {
+	return "Error<" + e.Message + ">"
+}
+
+func (e *RuntimeError) Equals(other Data) bool {
+	return e == other
+}
+
+func (e *RuntimeError) GetType() DataType {
+	return ErrorType
+}
+
+// Returns the stack trace as a list of strings, innermost call first
+func (e *RuntimeError) StackTrace() List {
+	trace := CreateList()
+	for _, frame := range e.Stack {
+		trace.PushBack(String{frame.String()})
+	}
+	if e.location != nil {
+		trace.PushBack(String{e.location.String()})
+	}
+	return trace
+}
+
+// Wraps anything raised during the evaluation of code into a runtime error
+// and locates it at the given expression if its position is not known yet
+func NewRuntimeError(reason interface{}, code Data) *RuntimeError {
+	var err *RuntimeError
+
+	switch t := reason.(type) {
+	case *RuntimeError:
+		err = t
+	case error:
+		err = &RuntimeError{Message: t.Error(), Data: CreateDict()}
+	default:
+		err = &RuntimeError{Message: fmt.Sprint(t), Data: CreateDict()}
+	}
+
+	err.locate(PositionOf(code))
+	return err
+}
+
+// Sets the position in the innermost frame unless it is known already
+func (e *RuntimeError) locate(pos *SourcePos) {
+	if e.location == nil {
+		e.location = pos
+		if e.Pos == nil {
+			e.Pos = pos
+		}
+	}
+}
+
+// Adds the function call in which the error occurred to the stack trace
+func (e *RuntimeError) pushFrame(function string, dispatch *DispatchPattern) {
+	e.Stack = append(e.Stack, StackFrame{function, dispatch.Signature(), e.location})
+	e.location = nil
+}
+
+// Adds a marker for function calls that have been left out of the stack trace, as tail
+// calls don't keep the frames of their callers
+func (e *RuntimeError) pushElided(calls int) {
+	e.Stack = append(e.Stack, StackFrame{"...", fmt.Sprintf("(%d tail calls)", calls), nil})
+}
+
+// Evaluates code in the given context and returns the result
+func Evaluate(code Data, context *Context) (result Data, err error) {
 	defer func() {
+		// errors raised while compiling, e.g. by macros
 		if e := recover(); e != nil {
-			fmt.Printf("%v in %v\n", e, code)
+			result, err = nil, NewRuntimeError(e, code)
 		}
 	}()
 
-	switch t := code.(type) {
-	case List:
-		// copy the list because we're going to mutate it
-		t = t.SliceFrom(0)
-
-		if t.evaluated {
-			// if the list was already evaluated just return its contents as is
-			return code, nil
-		} else if t.Len() == 0 {
-			return nil, errors.New("invalid function invocation")
-		}
+	return run(Compile(code, context), context, nil)
+}
 
-		// first expression must be a symbol
-		symbol, ok := t.Front().Value.(Symbol)
-		if ok {
-			// look up the value for that symbol
-			fn := context.LookUp(symbol)
-			if fn != nil {
-				// check if we can call it as a function
-				fn, ok := fn.(Caller)
-				if ok {
-					t.Remove(t.Front())
-					return fn.Call(t, context), nil
-				} else {
-					return nil, errors.New(fmt.Sprintf("%s is not a function", t.Get(0)))
-				}
-			} else {
-				return nil, errors.New(fmt.Sprintf("%s is not defined", t.Get(0)))
-			}
-		}
+// Special forms return a TailExpression for the expression in their tail position.
+// The caller continues with it instead of nesting another evaluation.
+type TailExpression struct {
+	Code    Data
+	Context *Context
+}
 
-		function, ok := t.Front().Value.(Function)
-		if ok {
-			t.Remove(t.Front()) // remove function name from list to get only arguments
-			return function.Call(t, context), nil
-		}
+func (t *TailExpression) String() string {
+	return "TailExpression<" + t.Code.String() + ">"
+}
 
-		return nil, errors.New(fmt.Sprintf("%s is neither a symbol nor a function and cannot be called as such", t.Get(0)))
-	case Keyword:
-		return t, nil
-	case Symbol:
-		// look up the symbol and returns its value
-		result := context.LookUp(t)
-		if result != nil {
-			return context.LookUp(t), nil
-		} else {
-			return nil, errors.New(fmt.Sprintf("%s is not defined", t.Value))
-		}
-	}
+func (t *TailExpression) Equals(other Data) bool {
+	return t == other
+}
 
-	return code, nil
+func (t *TailExpression) GetType() DataType {
+	return TailExpressionType
 }
 
 func initWatchdog() {
@@ -356,7 +481,7 @@ func REPL() {
 		}
 	}
 
-	gamehost_Window.SetShouldClose(true)
+	QuitGamehost()
 }
 
 func CreateMainContext() *Context {
@@ -368,15 +493,24 @@ func CreateMainContext() *Context {
 	context.symbols["Symbol"] = SymbolType
 	context.symbols["Keyword"] = KeywordType
 	context.symbols["List"] = ListType
+	context.symbols["Vector"] = VectorType
+	context.symbols["PersistentVector"] = PersistentVectorType
+	context.symbols["PersistentMap"] = PersistentMapType
+	context.symbols["PersistentSet"] = PersistentSetType
 	context.symbols["Dict"] = DictType
 	context.symbols["NativeFunction"] = NativeFunctionType
 	context.symbols["NativeFunctionB"] = NativeFunctionBType
+	context.symbols["Error"] = ErrorType
+	context.symbols["Macro"] = MacroType
+	context.symbols["Subscription"] = SubscriptionType
+	context.symbols["System"] = SystemType
+	context.symbols["Trait"] = TraitType
 
 	context.symbols["Nothing"] = Nothing{}
 	context.symbols["true"] = Bool{true}
 	context.symbols["false"] = Bool{false}
 
-	context.symbols["do"] = NativeFunction{_do}
+	context.symbols["do"] = NativeFunctionB{_do}
 	context.symbols["def"] = NativeFunctionB{_def}
 	context.symbols["type"] = NativeFunction{_type}
 	context.symbols["str"] = NativeFunction{_str}
@@ -385,14 +519,34 @@ func CreateMainContext() *Context {
 	context.symbols["defn|"] = NativeFunctionB{_extend_function}
 	context.symbols["lambda"] = NativeFunctionB{_lambda}
 
+	// macros
+	context.symbols["defmacro"] = NativeFunctionB{_defmacro}
+	context.symbols["macroexpand"] = NativeFunction{_macroexpand}
+	context.symbols["quote"] = NativeFunctionB{_quote}
+	context.symbols["quasiquote"] = NativeFunctionB{_quasiquote}
+	context.symbols["unquote"] = NativeFunctionB{_unquote}
+	context.symbols["unquote-splicing"] = NativeFunctionB{_unquote}
+
 	context.symbols["symbol"] = NativeFunction{_symbol}
 	context.symbols["keyword"] = NativeFunction{_keyword}
 	context.symbols["list"] = NativeFunction{_list}
+	context.symbols["vector"] = NativeFunction{_vector}
 	context.symbols["dict"] = NativeFunction{_dict}
 
 	context.symbols["print"] = NativeFunction{_print}
 
-	context.symbols["do"] = NativeFunction{_do}
+	// persistent collections
+	context.symbols["persistent-vector"] = NativeFunction{_persistent_vector}
+	context.symbols["persistent-map"] = NativeFunction{_persistent_map}
+	context.symbols["persistent-set"] = NativeFunction{_persistent_set}
+	context.symbols["persistent"] = NativeFunction{_persistent}
+	context.symbols["assoc"] = NativeFunction{_assoc}
+	context.symbols["dissoc"] = NativeFunction{_dissoc}
+	context.symbols["conj"] = NativeFunction{_conj}
+	context.symbols["contains?"] = NativeFunction{_contains}
+	context.symbols["get-in"] = NativeFunction{_get_in}
+	context.symbols["update-in"] = NativeFunction{_update_in}
+
 	context.symbols["let"] = NativeFunctionB{_let}
 	context.symbols["foreach"] = NativeFunction{_foreach}
 	context.symbols["map"] = NativeFunction{_map}
@@ -403,6 +557,14 @@ func CreateMainContext() *Context {
 	context.symbols["if"] = NativeFunctionB{_if}
 	context.symbols["="] = NativeFunction{_equals}
 
+	// error handling
+	context.symbols["try"] = NativeFunctionB{_try}
+	context.symbols["throw"] = NativeFunction{_throw}
+	context.symbols["error"] = NativeFunction{_error}
+	context.symbols["error-message"] = NativeFunction{_error_message}
+	context.symbols["error-data"] = NativeFunction{_error_data}
+	context.symbols["error-stack"] = NativeFunction{_error_stack}
+
 	context.symbols["get"] = NativeFunction{_get}
 	context.symbols["put"] = NativeFunction{_put}
 	context.symbols["slice"] = NativeFunction{_slice}
@@ -431,24 +593,61 @@ func CreateMainContext() *Context {
 	context.symbols["code"] = NativeFunction{_code}
 
 	context.symbols["entity"] = NativeFunction{_entity}
+	context.symbols["destroy"] = NativeFunction{_destroy}
+	context.symbols["alive?"] = NativeFunction{_alive}
+	context.symbols["Destroyed"] = DestroyedEvent
+	context.symbols["PropertyChanged"] = PropertyChangedEvent
+	context.symbols["add-component"] = NativeFunction{_add_component}
+	context.symbols["get-component"] = NativeFunction{_get_component}
+	context.symbols["remove-component"] = NativeFunction{_remove_component}
+	context.symbols["has-component?"] = NativeFunction{_has_component}
+	context.symbols["query"] = NativeFunction{_query}
+	context.symbols["deftrait"] = NativeFunctionB{_deftrait}
+	context.symbols["create-entity"] = NativeFunctionB{_create_entity}
+
+	context.symbols["system"] = NativeFunction{_system}
+	context.symbols["enable-system"] = NativeFunction{_enable_system}
+	context.symbols["disable-system"] = NativeFunction{_disable_system}
+	context.symbols["system-report"] = NativeFunction{_system_report}
 
 	context.symbols["defevent"] = NativeFunctionB{_defevent}
 	context.symbols["subscribe"] = NativeFunction{_subscribe}
 	context.symbols["unsubscribe"] = NativeFunction{_unsubscribe}
+	context.symbols["unsubscribe-all"] = NativeFunction{_unsubscribe_all}
 	context.symbols["trigger"] = NativeFunction{_trigger}
 	context.symbols["on"] = NativeFunction{_on}
+	context.symbols["on-change"] = NativeFunction{_on_change}
+	context.symbols["consume-event"] = NativeFunction{_consume_event}
 
 	// event system
 	eventBus := new(events.EventBus)
-	eventBus.Init()
+	if SynchronousEvents {
+		eventBus.InitSynchronous()
+	} else {
+		eventBus.Init()
+	}
 	context.symbols["$events"] = NativeObject{eventBus}
 
 	// import aux. functions defined in gamelisp itself
-	coreModule := GetModule("$core", context)
+	coreModule, err := GetModule("$core", context)
+	if err != nil {
+		panic(err)
+	}
 	context.Import(coreModule.context, "")
 
 	// graphics functions
 	context.symbols["fill-background"] = NativeFunction{fill_background}
+	context.symbols["camera"] = NativeFunction{_camera}
+	context.symbols["camera-look-at"] = NativeFunction{_camera_look_at}
+	context.symbols["camera-move"] = NativeFunction{_camera_move}
+	context.symbols["camera-turn"] = NativeFunction{_camera_turn}
+	context.symbols["camera-orbit"] = NativeFunction{_camera_orbit}
+	context.symbols["camera-perspective"] = NativeFunction{_camera_perspective}
+	context.symbols["camera-orthographic"] = NativeFunction{_camera_orthographic}
+	context.symbols["quit"] = NativeFunction{_quit}
+	context.symbols["frame-number"] = NativeFunction{_frame_number}
+	context.symbols["delta-time"] = NativeFunction{_delta_time}
+	context.symbols["elapsed-time"] = NativeFunction{_elapsed_time}
 
 	return context
 }
@@ -0,0 +1,287 @@
+package main
+
+//
+// This file contains the systems that update entities with certain components each frame
+//
+
+import "bytes"
+import "fmt"
+import "sort"
+import "sync"
+import "time"
+
+// Systems run phase by phase, within a phase by their order and then by definition
+var SystemPhases = []Keyword{{":input"}, {":update"}, {":physics"}, {":render"}}
+
+type System struct {
+	Name       string
+	Components []Keyword
+	Phase      Keyword
+	Order      int
+	Function   Caller
+	Enabled    bool
+
+	context *Context
+
+	// index of the phase in SystemPhases
+	phase int
+
+	// definition order of the system
+	sequence int
+
+	// timing statistics
+	calls     int
+	totalTime time.Duration
+	maxTime   time.Duration
+}
+
+func (s *System) String() string {
+	return "System<" + s.Name + ">"
+}
+
+func (s *System) Equals(other Data) bool {
+	return s == other
+}
+
+func (s *System) GetType() DataType {
+	return SystemType
+}
+
+// Runs the system for all entities having its components, or once if it has none
+func (s *System) run(dt float64) {
+	if len(s.Components) == 0 {
+		CallWithValues(s.Function, MakeList(Float{dt}), s.context)
+		return
+	}
+
+	for _, entity := range entityComponents.query(s.Components) {
+		CallWithValues(s.Function, MakeList(entity, Float{dt}), s.context)
+	}
+}
+
+type Scheduler struct {
+	systems  []*System
+	sequence int
+	mutex    sync.Mutex
+}
+
+var systemScheduler = new(Scheduler)
+
+// Adds the system to the scheduler. A system with the same name is replaced, e.g. when
+// its module is reloaded, but keeps its timing statistics.
+func (scheduler *Scheduler) Define(system *System) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	for i, existing := range scheduler.systems {
+		if existing.Name == system.Name {
+			system.sequence = existing.sequence
+			system.calls, system.totalTime, system.maxTime = existing.calls, existing.totalTime, existing.maxTime
+			scheduler.systems[i] = system
+			scheduler.sort()
+			return
+		}
+	}
+
+	scheduler.sequence++
+	system.sequence = scheduler.sequence
+	scheduler.systems = append(scheduler.systems, system)
+	scheduler.sort()
+}
+
+func (scheduler *Scheduler) sort() {
+	sort.SliceStable(scheduler.systems, func(i, j int) bool {
+		a, b := scheduler.systems[i], scheduler.systems[j]
+		if a.phase != b.phase {
+			return a.phase < b.phase
+		}
+		if a.Order != b.Order {
+			return a.Order < b.Order
+		}
+		return a.sequence < b.sequence
+	})
+}
+
+// Returns the system with the given name or nil
+func (scheduler *Scheduler) Get(name string) *System {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	for _, system := range scheduler.systems {
+		if system.Name == name {
+			return system
+		}
+	}
+	return nil
+}
+
+func (scheduler *Scheduler) SetEnabled(system *System, enabled bool) {
+	scheduler.mutex.Lock()
+	system.Enabled = enabled
+	scheduler.mutex.Unlock()
+}
+
+// Runs all enabled systems in order. A failing system is reported and disabled.
+func (scheduler *Scheduler) Run(dt float64) {
+	scheduler.mutex.Lock()
+	systems := make([]*System, 0, len(scheduler.systems))
+	for _, system := range scheduler.systems {
+		if system.Enabled {
+			systems = append(systems, system)
+		}
+	}
+	scheduler.mutex.Unlock()
+
+	for _, system := range systems {
+		scheduler.runSystem(system, dt)
+	}
+}
+
+func (scheduler *Scheduler) runSystem(system *System, dt float64) {
+	start := time.Now()
+
+	defer func() {
+		elapsed := time.Since(start)
+
+		scheduler.mutex.Lock()
+		system.calls++
+		system.totalTime += elapsed
+		if elapsed > system.maxTime {
+			system.maxTime = elapsed
+		}
+		scheduler.mutex.Unlock()
+
+		if e := recover(); e != nil {
+			scheduler.SetEnabled(system, false)
+			fmt.Printf("System %s failed and has been disabled: %s\n", system.Name, NewRuntimeError(e, nil).Error())
+		}
+	}()
+
+	system.run(dt)
+}
+
+// Returns a table of the systems with their timing statistics, slowest systems first
+func (scheduler *Scheduler) Report() string {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	systems := make([]*System, len(scheduler.systems))
+	copy(systems, scheduler.systems)
+
+	sort.SliceStable(systems, func(i, j int) bool {
+		return systems[i].totalTime > systems[j].totalTime
+	})
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "%-24s %-10s %8s %12s %12s %12s\n", "System", "Phase", "Calls", "Total ms", "Avg ms", "Max ms")
+	for _, s := range systems {
+		avg := 0.0
+		if s.calls > 0 {
+			avg = milliseconds(s.totalTime) / float64(s.calls)
+		}
+
+		name := s.Name
+		if !s.Enabled {
+			name += " (disabled)"
+		}
+
+		fmt.Fprintf(&buffer, "%-24s %-10s %8d %12.3f %12.3f %12.3f\n", name, s.Phase.Value, s.calls,
+			milliseconds(s.totalTime), avg, milliseconds(s.maxTime))
+	}
+
+	return buffer.String()
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+//-----------------------------------------------------------------------------
+// Native Functions for systems
+
+// (system name [:component1 :component2 ...] [:phase :update] [:order 0] function)
+// defines a system, which is called each frame with (entity dt) for each entity having
+// all of the components, or with (dt) once if there are no components.
+// Use (defsystem name ...) to define it under its name, too.
+func _system(args List, context *Context) Data {
+	args.RequireArity(3)
+
+	system := new(System)
+	system.Name = args.First().(Symbol).Value
+	system.Phase = Keyword{":update"}
+	system.Enabled = true
+	system.context = context
+
+	for _, component := range sequenceItems(args.Second()) {
+		system.Components = append(system.Components, component.(Keyword))
+	}
+
+	options := args.SliceFrom(2)
+	fn, ok := options.Get(options.Len() - 1).(Caller)
+	if !ok {
+		panic(fmt.Sprintf("%s is not a function", options.Get(options.Len()-1).String()))
+	}
+	system.Function = fn
+
+	for i := 0; i+1 < options.Len()-1; i += 2 {
+		switch options.Get(i).(Keyword).Value {
+		case ":phase":
+			system.Phase = options.Get(i + 1).(Keyword)
+		case ":order":
+			system.Order = options.Get(i + 1).(Int).Value
+		default:
+			panic(fmt.Sprintf("Unknown system option %s", options.Get(i).String()))
+		}
+	}
+
+	system.phase = -1
+	for i, phase := range SystemPhases {
+		if phase.Equals(system.Phase) {
+			system.phase = i
+		}
+	}
+	if system.phase < 0 {
+		panic(fmt.Sprintf("Unknown system phase %s", system.Phase.Value))
+	}
+
+	systemScheduler.Define(system)
+	return system
+}
+
+// returns the system given by itself or its name
+func systemArgument(data Data) *System {
+	switch t := data.(type) {
+	case *System:
+		return t
+	case Symbol:
+		if system := systemScheduler.Get(t.Value); system != nil {
+			return system
+		}
+	case String:
+		if system := systemScheduler.Get(t.Value); system != nil {
+			return system
+		}
+	}
+
+	panic(fmt.Sprintf("%s is not a system", data.String()))
+}
+
+// (enable-system system)
+func _enable_system(args List, context *Context) Data {
+	args.RequireArity(1)
+	systemScheduler.SetEnabled(systemArgument(args.First()), true)
+	return Nothing{}
+}
+
+// (disable-system system)
+func _disable_system(args List, context *Context) Data {
+	args.RequireArity(1)
+	systemScheduler.SetEnabled(systemArgument(args.First()), false)
+	return Nothing{}
+}
+
+// (system-report) - prints the timing statistics of all systems
+func _system_report(args List, context *Context) Data {
+	fmt.Print(systemScheduler.Report())
+	return Nothing{}
+}
@@ -0,0 +1,332 @@
+package main
+
+//
+// This file contains traits, which bundle components with default values and event handlers
+//
+
+import "fmt"
+import "sync"
+
+type Trait struct {
+	Name string
+
+	// component names in the order of definition, which is the order of positional overrides
+	Properties []Keyword
+	Defaults   Dict
+
+	Handlers []TraitHandler
+
+	// entities composed of this trait
+	members []*traitMember
+	mutex   sync.Mutex
+}
+
+// An event handler every entity with the trait is subscribed to. It receives the events
+// triggered by the entity itself.
+type TraitHandler struct {
+	Event    string
+	Function *Function
+}
+
+// traits by the ID of the entities composed of them
+var entityTraits = struct {
+	sync.Mutex
+	byEntity map[uint64][]*Trait
+}{byEntity: make(map[uint64][]*Trait)}
+
+type traitMember struct {
+	entity *Entity
+
+	// values given instead of the defaults when the entity was created
+	overrides Dict
+
+	subscriptions []*UserEventHandler
+}
+
+func (t *Trait) String() string {
+	return "Trait<" + t.Name + ">"
+}
+
+func (t *Trait) Equals(other Data) bool {
+	return t == other
+}
+
+func (t *Trait) GetType() DataType {
+	return TraitType
+}
+
+func (t *Trait) hasProperty(name Keyword) bool {
+	_, ok := t.Defaults.Get(name)
+	return ok
+}
+
+// Assigns the arguments given for the trait in create-entity to its properties. Arguments are
+// either given by position (value1 value2 ...) or by name (:property1 value1 ...).
+func (t *Trait) bindOverrides(args List) Dict {
+	overrides := CreateDict()
+
+	if t.isKeywordArguments(args) {
+		for i := 0; i < args.Len(); i += 2 {
+			key := args.Get(i).(Keyword)
+			if !t.hasProperty(key) {
+				panic(fmt.Sprintf("Unknown property %s of trait %s", key.String(), t.Name))
+			}
+			overrides.Put(key, args.Get(i+1))
+		}
+	} else {
+		if args.Len() > len(t.Properties) {
+			panic(fmt.Sprintf("Too many values for trait %s: expected %d, got %d", t.Name,
+				len(t.Properties), args.Len()))
+		}
+		args.Foreach(func(arg Data, i int) {
+			overrides.Put(t.Properties[i], arg)
+		})
+	}
+
+	return overrides
+}
+
+// like the arguments of events, values are given by name if they come in pairs starting with
+// a keyword that either names a property or can't be a positional value
+func (t *Trait) isKeywordArguments(args List) bool {
+	if args.Len() == 0 || args.Len()%2 != 0 {
+		return false
+	}
+
+	key, ok := args.First().(Keyword)
+	if !ok {
+		return false
+	}
+
+	return t.hasProperty(key) || args.Len() > len(t.Properties)
+}
+
+// Adds the components of the trait to the entity and subscribes it to the trait's events
+func (t *Trait) Attach(entity *Entity, overrides Dict, context *Context) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	member := &traitMember{entity: entity, overrides: overrides}
+	for _, property := range t.Properties {
+		value, ok := overrides.Get(property)
+		if !ok {
+			value, _ = t.Defaults.Get(property)
+			value = copyDefault(value)
+		}
+		entity.Set(property, value)
+	}
+
+	member.subscribe(t.Handlers, context)
+	t.members = append(t.members, member)
+
+	entityTraits.Lock()
+	entityTraits.byEntity[entity.id] = append(entityTraits.byEntity[entity.id], t)
+	entityTraits.Unlock()
+}
+
+// Removes the destroyed entity from the members of its traits
+func leaveTraits(entity *Entity) {
+	entityTraits.Lock()
+	traits := entityTraits.byEntity[entity.id]
+	delete(entityTraits.byEntity, entity.id)
+	entityTraits.Unlock()
+
+	for _, t := range traits {
+		t.mutex.Lock()
+		for i, member := range t.members {
+			if member.entity.id == entity.id {
+				t.members = append(t.members[:i:i], t.members[i+1:]...)
+				break
+			}
+		}
+		t.mutex.Unlock()
+	}
+}
+
+func (member *traitMember) subscribe(handlers []TraitHandler, context *Context) {
+	eventBus := context.GetEventBus()
+	for _, handler := range handlers {
+		subscription := SubscribeUserEvent(eventBus, member.entity, handler.Event, member.entity,
+			handler.Function, 0)
+		member.subscriptions = append(member.subscriptions, subscription)
+	}
+}
+
+func (member *traitMember) unsubscribe() {
+	for _, subscription := range member.subscriptions {
+		subscription.Unsubscribe()
+	}
+	member.subscriptions = nil
+}
+
+// Replaces the definition of the trait, e.g. when its module has been reloaded. Entities that
+// still have the old default value of a property get the new one, as do entities missing a
+// property that has been added, which triggers PropertyChanged. Overridden or changed values
+// are kept. The entities are subscribed to the new event handlers.
+func (t *Trait) Redefine(definition *Trait, context *Context) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	eventBus := context.GetEventBus()
+	oldDefaults := t.Defaults
+	t.Properties = definition.Properties
+	t.Defaults = definition.Defaults
+	t.Handlers = definition.Handlers
+
+	members := t.members[:0]
+	for _, member := range t.members {
+		// destroyed entities have lost their components and handlers already
+		if !member.entity.Alive() {
+			continue
+		}
+		members = append(members, member)
+
+		for _, property := range t.Properties {
+			if _, overridden := member.overrides.Get(property); overridden {
+				continue
+			}
+
+			newDefault, _ := t.Defaults.Get(property)
+			oldDefault, existed := oldDefaults.Get(property)
+			current, has := member.entity.Get(property)
+
+			if (!existed && !has) || (existed && has && current.Equals(oldDefault)) {
+				member.entity.SetProperty(property, copyDefault(newDefault), eventBus)
+			}
+		}
+
+		member.unsubscribe()
+		member.subscribe(t.Handlers, context)
+	}
+
+	t.members = members
+}
+
+// Mutable default values are copied, so that entities don't share them
+func copyDefault(data Data) Data {
+	switch t := data.(type) {
+	case Vector:
+		items := make([]Data, 0, t.Len())
+		for _, item := range t.Items() {
+			items = append(items, copyDefault(item))
+		}
+		return MakeVector(items...)
+	case List:
+		list := CreateList()
+		list.evaluated = t.evaluated
+		t.Foreach(func(item Data, i int) {
+			list.PushBack(copyDefault(item))
+		})
+		return list
+	case Dict:
+		dict := CreateDict()
+		t.Foreach(func(key Data, value Data) {
+			dict.Put(key, copyDefault(value))
+		})
+		return dict
+	}
+
+	return data
+}
+
+//-----------------------------------------------------------------------------
+// Native Functions for traits
+
+// (deftrait Name
+//     (properties :property1 default1 :property2 default2 ...)
+//     (on (Event1 handler1) ("Namespace/*" handler2) ...))
+// Redefining a trait updates the entities composed of it.
+func _deftrait(args List, context *Context) Data {
+	name := args.First().(Symbol)
+
+	trait := new(Trait)
+	trait.Name = name.Value
+	trait.Defaults = CreateDict()
+
+	args.SliceFrom(1).Foreach(func(section Data, i int) {
+		clause, ok := section.(List)
+		if !ok || clause.Len() == 0 {
+			panic(fmt.Sprintf("Invalid section %s of trait %s", section.String(), trait.Name))
+		}
+
+		switch clause.First().String() {
+		case "properties":
+			properties := clause.SliceFrom(1)
+			if properties.Len()%2 != 0 {
+				panic(fmt.Sprintf("Missing default value for a property of trait %s", trait.Name))
+			}
+			for e := properties.Front(); e != nil; e = e.Next().Next() {
+				property := e.Value.(Keyword)
+				trait.Properties = append(trait.Properties, property)
+				trait.Defaults.Put(property, evaluateOrPanic(e.Next().Value.(Data), context))
+			}
+		case "on":
+			clause.SliceFrom(1).Foreach(func(handler Data, i int) {
+				pair := handler.(List)
+				pair.RequireArity(2)
+				trait.Handlers = append(trait.Handlers, TraitHandler{
+					Event:    subscribedEvents(evaluateOrPanic(pair.First(), context)),
+					Function: evaluateOrPanic(pair.Second(), context).(*Function),
+				})
+			})
+		default:
+			panic(fmt.Sprintf("Unknown section %s of trait %s", clause.First().String(), trait.Name))
+		}
+	})
+
+	if existing, ok := context.LookUp(name).(*Trait); ok && existing.Name == trait.Name {
+		existing.Redefine(trait, context)
+		return existing
+	}
+
+	context.Define(name, trait)
+	return trait
+}
+
+func evaluateOrPanic(code Data, context *Context) Data {
+	value, err := Evaluate(code, context)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// (create-entity Trait1 (Trait2 value1 ...) (Trait3 :property1 value1 ...) ...)
+// creates an entity composed of the given traits. Values of properties defined by several
+// traits are taken from the last one.
+func _create_entity(args List, context *Context) Data {
+	entity := NewEntity()
+
+	args.Foreach(func(arg Data, i int) {
+		var trait *Trait
+		overrides := CreateDict()
+
+		switch t := arg.(type) {
+		case List:
+			t.RequireArity(1)
+			trait = traitArgument(evaluateOrPanic(t.First(), context))
+
+			values := CreateList()
+			t.SliceFrom(1).Foreach(func(value Data, i int) {
+				values.PushBack(evaluateOrPanic(value, context))
+			})
+			if values.Len() > 0 {
+				overrides = trait.bindOverrides(values)
+			}
+		default:
+			trait = traitArgument(evaluateOrPanic(arg, context))
+		}
+
+		trait.Attach(entity, overrides, context)
+	})
+
+	return entity
+}
+
+func traitArgument(data Data) *Trait {
+	if trait, ok := data.(*Trait); ok {
+		return trait
+	}
+
+	panic(fmt.Sprintf("%s is not a trait", data.String()))
+}
@@ -0,0 +1,247 @@
+package main
+
+//
+// This file contains the virtual machine running the bytecode produced by the compiler
+//
+
+import "fmt"
+
+// maximum number of nested function calls
+const maxFrames = 100000
+
+// The call of a user-defined function whose body is being evaluated
+type activation struct {
+	function string
+	dispatch *DispatchPattern
+}
+
+type frame struct {
+	chunk   *Chunk
+	ip      int
+	context *Context
+
+	// size of the value stack when the frame was entered
+	base int
+
+	// the function call or nil on top level
+	call *activation
+
+	// position of the call that created the frame
+	caller *SourcePos
+
+	// the call the frame was entered with and the position of its tail call, once tail
+	// calls have replaced it, and the number of tail calls dropped since then
+	entry    *activation
+	entryPos *SourcePos
+	elided   int
+}
+
+type machine struct {
+	frames []frame
+	stack  []Data
+}
+
+// Runs a chunk in the given context. call is the function call the chunk
+// is the body of, or nil if it is run on top level.
+func run(chunk *Chunk, context *Context, call *activation) (result Data, err error) {
+	vm := &machine{
+		frames: []frame{{chunk: chunk, context: context, call: call}},
+		stack:  make([]Data, 0, 16),
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			result, err = nil, vm.unwind(e)
+		}
+	}()
+
+	return vm.execute(), nil
+}
+
+func (vm *machine) push(value Data) {
+	vm.stack = append(vm.stack, value)
+}
+
+func (vm *machine) pop() Data {
+	value := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return value
+}
+
+func (vm *machine) execute() Data {
+	for {
+		f := &vm.frames[len(vm.frames)-1]
+		instruction := f.chunk.Code[f.ip]
+		f.ip++
+
+		switch instruction.Op {
+		case opConst:
+			vm.push(f.chunk.Constants[instruction.A])
+
+		case opLocal:
+			vm.push(lookUpSlot(f.context, instruction.A, instruction.B))
+
+		case opName:
+			symbol := f.chunk.Constants[instruction.A].(Symbol)
+			value := f.context.LookUp(symbol)
+			if value == nil {
+				panic(fmt.Sprintf("%s is not defined", symbol.Value))
+			}
+			vm.push(value)
+
+		case opCallee:
+			switch callee := vm.stack[len(vm.stack)-1].(type) {
+			case *Function, NativeFunction:
+				// the arguments are evaluated by the following instructions
+				continue
+			case Caller:
+				// special forms, macros and other callers receive the unevaluated arguments
+				vm.stack[len(vm.stack)-1] = callee.Call(rawArguments(f, instruction), f.context)
+			default:
+				panic(fmt.Sprintf("%s is not a function", f.chunk.Constants[instruction.A].(List).Get(0)))
+			}
+			f.ip = instruction.B
+
+		case opCall, opTailCall:
+			argc := instruction.A
+			args := vm.stack[len(vm.stack)-argc:]
+			callee := vm.stack[len(vm.stack)-argc-1]
+
+			switch fn := callee.(type) {
+			case *Function:
+				dispatch := fn.selectDispatch(args)
+				context := dispatch.bind(args)
+				vm.stack = vm.stack[:len(vm.stack)-argc-1]
+
+				call := &activation{fn.Name, dispatch}
+				if instruction.Op == opTailCall {
+					// replace the current frame, so that tail calls run in constant stack space.
+					// Only the first and the last call are kept for stack traces.
+					switch {
+					case f.call == nil:
+						f.caller = f.chunk.Positions[f.ip-1]
+					case f.entry == nil:
+						f.entry, f.entryPos = f.call, f.chunk.Positions[f.ip-1]
+					default:
+						f.elided++
+					}
+					vm.stack = vm.stack[:f.base]
+					f.chunk, f.ip, f.context, f.call = dispatch.body, 0, context, call
+				} else {
+					if len(vm.frames) >= maxFrames {
+						panic("Stack overflow")
+					}
+					vm.frames = append(vm.frames, frame{chunk: dispatch.body, context: context, base: len(vm.stack), call: call, caller: f.chunk.Positions[f.ip-1]})
+				}
+			case NativeFunction:
+				result := fn.Function(MakeList(args...), f.context)
+				vm.stack = vm.stack[:len(vm.stack)-argc-1]
+				vm.push(result)
+			}
+
+		case opJumpIfFalse:
+			value := vm.pop()
+			boolean, ok := value.(Bool)
+			if !ok {
+				panic(fmt.Sprintf("%s is not a Bool", value.String()))
+			}
+			if !boolean.Value {
+				f.ip = instruction.A
+			}
+
+		case opJump:
+			f.ip = instruction.A
+
+		case opPop:
+			vm.pop()
+
+		case opDefine:
+			f.context.Define(f.chunk.Constants[instruction.A].(Symbol), vm.stack[len(vm.stack)-1])
+
+		case opFunction:
+			fn := f.chunk.Functions[instruction.A].instantiate(f.context)
+			name := f.chunk.Functions[instruction.A].name
+
+			switch instruction.B {
+			case functionDefine:
+				vm.push(defineFunction(name, fn, f.context))
+			case functionExtend:
+				vm.push(extendFunction(name, fn, f.context))
+			default:
+				vm.push(fn)
+			}
+
+		case opPushScope:
+			names := f.chunk.Scopes[instruction.A]
+			slots := make([]Data, len(names))
+			copy(slots, vm.stack[len(vm.stack)-len(names):])
+			vm.stack = vm.stack[:len(vm.stack)-len(names)]
+			f.context = NewSlotContext(f.context, names, slots)
+
+		case opPopScope:
+			f.context = f.context.parent
+
+		case opRaise:
+			panic(f.chunk.Constants[instruction.A].(String).Value)
+
+		case opReturn:
+			result := vm.pop()
+			vm.stack = vm.stack[:f.base]
+			vm.frames = vm.frames[:len(vm.frames)-1]
+
+			if len(vm.frames) == 0 {
+				return result
+			}
+			vm.push(result)
+		}
+	}
+}
+
+// returns the unevaluated arguments of the call form, copied because the called function may mutate them
+func rawArguments(f *frame, instruction Instruction) List {
+	return f.chunk.Constants[instruction.A].(List).SliceFrom(1)
+}
+
+// returns the value of a slot depth contexts up the context chain. The contexts in between
+// are checked for a definition of the same name, as def can define symbols in any context.
+func lookUpSlot(context *Context, depth int, index int) Data {
+	target := context
+	for i := 0; i < depth; i++ {
+		target = target.parent
+	}
+
+	name := target.slotNames[index]
+	for ; context != target; context = context.parent {
+		if value, defined := context.symbols[name]; defined {
+			return value
+		}
+	}
+
+	return target.slots[index]
+}
+
+// converts a raised error into a runtime error with a stack trace of the active calls
+func (vm *machine) unwind(reason interface{}) *RuntimeError {
+	err := NewRuntimeError(reason, nil)
+
+	for i := len(vm.frames) - 1; i >= 0; i-- {
+		f := vm.frames[i]
+		if f.ip > 0 {
+			err.locate(f.chunk.Positions[f.ip-1])
+		}
+
+		if f.call != nil {
+			err.pushFrame(f.call.function, f.call.dispatch)
+			if f.entry != nil {
+				if f.elided > 0 {
+					err.pushElided(f.elided)
+				}
+				err.locate(f.entryPos)
+				err.pushFrame(f.entry.function, f.entry.dispatch)
+			}
+			err.locate(f.caller)
+		}
+	}
+
+	return err
+}